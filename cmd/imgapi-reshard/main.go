@@ -0,0 +1,26 @@
+// Command imgapi-reshard converts a flat FileStore data directory into the
+// sharded layout enabled by IMGAPI_LAYOUT=sharded. Stop the service first.
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/nsarup/imgapi/internal/config"
+	"github.com/nsarup/imgapi/internal/logging"
+	"github.com/nsarup/imgapi/internal/storage"
+)
+
+func main() {
+	cfg := config.LoadFromEnv()
+	log := logging.New(os.Stdout)
+
+	dataDir := flag.String("data-dir", cfg.DataDir, "data directory to reshard")
+	flag.Parse()
+
+	n, err := storage.Reshard(*dataDir)
+	if err != nil {
+		log.Fatalf("reshard %s: moved %d images before error: %v", *dataDir, n, err)
+	}
+	log.Printf("resharded %s: moved %d images", *dataDir, n)
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 
+	"github.com/nsarup/imgapi/internal/cache"
 	"github.com/nsarup/imgapi/internal/config"
 	"github.com/nsarup/imgapi/internal/httpapi"
 	"github.com/nsarup/imgapi/internal/logging"
+	"github.com/nsarup/imgapi/internal/processing"
 	"github.com/nsarup/imgapi/internal/service"
 	"github.com/nsarup/imgapi/internal/storage"
 )
@@ -15,11 +18,31 @@ func main() {
 	cfg := config.LoadFromEnv()
 	log := logging.New(os.Stdout)
 
-	store, err := storage.NewFileStore(cfg.DataDir)
+	store, err := newStore(cfg)
 	if err != nil {
 		log.Fatalf("failed to init storage: %v", err)
 	}
-	svc := service.New(store)
+	var opts []service.Option
+	if cfg.CacheDir != "" {
+		c, err := cache.NewDisk(cfg.CacheDir, cfg.CacheMaxBytes)
+		if err != nil {
+			log.Fatalf("failed to init cache: %v", err)
+		}
+		opts = append(opts, service.WithCache(c))
+	}
+	if cfg.StripMetadata {
+		opts = append(opts, service.WithMetadataStripping(processing.StripPolicy{
+			KeepICC:         cfg.StripKeepICC,
+			KeepOrientation: cfg.StripKeepOrientation,
+		}))
+	}
+	if cfg.ExtractMetadata {
+		opts = append(opts, service.WithMetadataExtraction())
+	}
+	if cfg.Watermark != "" {
+		opts = append(opts, service.WithDefaultWatermark(cfg.Watermark))
+	}
+	svc := service.New(store, opts...)
 	srv := httpapi.NewServer(cfg, log, svc)
 
 	log.Printf("listening on %s", cfg.Addr)
@@ -27,3 +50,34 @@ func main() {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// newStore builds the storage backend selected by cfg.Storage.
+func newStore(cfg config.Config) (storage.Store, error) {
+	switch cfg.Storage {
+	case "", "file":
+		var opts []storage.FileStoreOption
+		if cfg.ContentAddressed {
+			opts = append(opts, storage.WithContentAddressing())
+		}
+		switch cfg.Layout {
+		case "", "flat":
+		case "sharded":
+			opts = append(opts, storage.WithShardedLayout())
+		default:
+			return nil, fmt.Errorf("unknown file layout %q", cfg.Layout)
+		}
+		return storage.NewFileStore(cfg.DataDir, opts...)
+	case "s3":
+		return storage.NewS3Store(storage.S3Config{
+			Endpoint:         cfg.S3.Endpoint,
+			Bucket:           cfg.S3.Bucket,
+			Region:           cfg.S3.Region,
+			AccessKey:        cfg.S3.AccessKey,
+			SecretKey:        cfg.S3.SecretKey,
+			Prefix:           cfg.S3.Prefix,
+			ContentAddressed: cfg.ContentAddressed,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+	}
+}
@@ -1,7 +1,7 @@
 module github.com/nsarup/imgapi
 
-go 1.22.5
+go 1.26.0
 
 require github.com/disintegration/imaging v1.6.2
 
-require golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
+require golang.org/x/image v0.46.0
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Disk is a size-capped, least-recently-used cache of processed image variants
+// stored on the local filesystem. Entries live at {dir}/{id}/{hash(key)} so all
+// variants of an image can be dropped at once.
+type Disk struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	lru   *list.List               // front is most recently used
+	items map[string]*list.Element // relative path -> element
+	size  int64
+}
+
+type entry struct {
+	path string // relative to dir
+	size int64
+}
+
+// NewDisk opens (or creates) a cache rooted at dir holding at most maxBytes.
+// Existing entries are indexed oldest-first so they are evicted first.
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if dir == "" {
+		return nil, errors.New("cache dir required")
+	}
+	if maxBytes <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &Disk{dir: dir, maxBytes: maxBytes, lru: list.New(), items: make(map[string]*list.Element)}
+
+	type found struct {
+		entry
+		mod int64
+	}
+	var existing []found
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			_ = os.Remove(p) // interrupted write
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		existing = append(existing, found{entry{rel, info.Size()}, info.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].mod > existing[j].mod })
+	for _, f := range existing {
+		c.items[f.path] = c.lru.PushBack(&entry{f.path, f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Get returns the cached variant of image id for key and its content type.
+func (c *Disk) Get(id, key string) ([]byte, string, bool) {
+	if !validID(id) {
+		return nil, "", false
+	}
+	rel := entryPath(id, key)
+	c.mu.Lock()
+	el, ok := c.items[rel]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, rel))
+	if err != nil {
+		c.mu.Lock()
+		c.removeLocked(rel)
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	ct, data, ok := decodeEntry(b)
+	return data, ct, ok
+}
+
+// Put stores a variant of image id under key, evicting older entries as needed.
+// Variants larger than the whole cache are not stored.
+func (c *Disk) Put(id, key string, data []byte, contentType string) error {
+	b := encodeEntry(contentType, data)
+	if !validID(id) || int64(len(b)) > c.maxBytes {
+		return nil
+	}
+	rel := entryPath(id, key)
+	full := filepath.Join(c.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), full)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[rel]; ok {
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+	}
+	c.items[rel] = c.lru.PushFront(&entry{rel, int64(len(b))})
+	c.size += int64(len(b))
+	c.evictLocked()
+	return nil
+}
+
+// Invalidate drops every cached variant of image id.
+func (c *Disk) Invalidate(id string) error {
+	if !validID(id) {
+		return nil
+	}
+	c.mu.Lock()
+	prefix := id + string(filepath.Separator)
+	for rel := range c.items {
+		if strings.HasPrefix(rel, prefix) {
+			c.removeLocked(rel)
+		}
+	}
+	c.mu.Unlock()
+	return os.RemoveAll(filepath.Join(c.dir, id))
+}
+
+// Size returns the number of bytes currently cached.
+func (c *Disk) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *Disk) evictLocked() {
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		rel := el.Value.(*entry).path
+		c.removeLocked(rel)
+		_ = os.Remove(filepath.Join(c.dir, rel))
+	}
+}
+
+func (c *Disk) removeLocked(rel string) {
+	if el, ok := c.items[rel]; ok {
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+		delete(c.items, rel)
+	}
+}
+
+// entryPath maps an image ID and canonical options key to a relative path.
+func entryPath(id, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(id, hex.EncodeToString(sum[:16]))
+}
+
+// Entries are stored as "<content type>\n<data>".
+func encodeEntry(contentType string, data []byte) []byte {
+	b := make([]byte, 0, len(contentType)+1+len(data))
+	b = append(b, contentType...)
+	b = append(b, '\n')
+	return append(b, data...)
+}
+
+func decodeEntry(b []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return "", nil, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
+
+// validID guards against IDs that would escape the cache directory.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
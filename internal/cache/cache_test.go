@@ -0,0 +1,52 @@
+package cache_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nsarup/imgapi/internal/cache"
+)
+
+func TestDiskLRUEviction(t *testing.T) {
+	dir := t.TempDir()
+	// each entry is 100 bytes of data plus "image/png\n"
+	c, err := cache.NewDisk(dir, 250)
+	if err != nil {
+		t.Fatalf("NewDisk: %v", err)
+	}
+	data := bytes.Repeat([]byte{1}, 100)
+	if err := c.Put("a", "k", data, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("b", "k", data, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get("a", "k"); !ok { // a becomes most recent
+		t.Fatal("a missing")
+	}
+	if err := c.Put("c", "k", data, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get("b", "k"); ok {
+		t.Fatal("least recently used entry b was not evicted")
+	}
+	got, ct, ok := c.Get("a", "k")
+	if !ok || ct != "image/png" || !bytes.Equal(got, data) {
+		t.Fatalf("a = %v %q %v", len(got), ct, ok)
+	}
+
+	// a reopened cache indexes what is on disk
+	c2, err := cache.NewDisk(dir, 250)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if c2.Size() != c.Size() {
+		t.Fatalf("reopened size %d, want %d", c2.Size(), c.Size())
+	}
+	if err := c2.Invalidate("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c2.Get("a", "k"); ok {
+		t.Fatal("invalidated entry still served")
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 )
 
 // Config holds runtime configuration for the service.
@@ -10,12 +11,58 @@ type Config struct {
 	Addr string
 	// DataDir is the base directory for persisted image data.
 	DataDir string
+	// Layout selects the file backend's directory layout: "flat" (default) or
+	// "sharded" (ab/cd/{id}); convert existing data with imgapi-reshard.
+	Layout string
 	// MaxUploadBytes limits the maximum upload size accepted by the API.
 	MaxUploadBytes int64
+	// Storage selects the storage backend: "file" (default) or "s3".
+	Storage string
+	// S3 configures the S3-compatible backend when Storage is "s3".
+	S3 S3Config
+	// CacheDir enables the on-disk cache of processed variants when non-empty.
+	CacheDir string
+	// CacheMaxBytes caps the size of the variant cache; least recently used
+	// variants are evicted first.
+	CacheMaxBytes int64
+	// CacheControl is sent as the Cache-Control header on image responses;
+	// empty disables the header.
+	CacheControl string
+	// ContentAddressed stores images under the SHA-256 of their content so
+	// identical uploads are deduplicated and share one ID.
+	ContentAddressed bool
+	// StripMetadata removes EXIF, XMP, IPTC, comments and text chunks from
+	// JPEG and PNG uploads before they are stored.
+	StripMetadata bool
+	// StripKeepICC keeps ICC colour profiles when stripping (default true).
+	StripKeepICC bool
+	// StripKeepOrientation keeps the EXIF orientation when stripping (default true).
+	StripKeepOrientation bool
+	// ExtractMetadata parses EXIF, IPTC and XMP metadata at upload time and
+	// stores it with the image record (before any stripping; GPS and device
+	// fields are dropped when StripMetadata is also set).
+	ExtractMetadata bool
+	// Watermark is the stored image ID used for wm=default; empty disables it.
+	Watermark string
+}
+
+// S3Config holds settings for an S3-compatible object store (AWS, MinIO, Ceph).
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
 }
 
 // LoadFromEnv loads configuration from environment variables with sensible defaults.
-// IMGAPI_ADDR, IMGAPI_DATA_DIR, IMGAPI_MAX_UPLOAD_MB
+// IMGAPI_ADDR, IMGAPI_DATA_DIR, IMGAPI_LAYOUT, IMGAPI_MAX_UPLOAD_MB, IMGAPI_STORAGE,
+// IMGAPI_S3_ENDPOINT, IMGAPI_S3_BUCKET, IMGAPI_S3_REGION, IMGAPI_S3_ACCESS_KEY,
+// IMGAPI_S3_SECRET_KEY, IMGAPI_S3_PREFIX, IMGAPI_CONTENT_ADDRESSED,
+// IMGAPI_CACHE_DIR, IMGAPI_CACHE_MAX_MB, IMGAPI_CACHE_CONTROL,
+// IMGAPI_STRIP_METADATA, IMGAPI_STRIP_KEEP_ICC, IMGAPI_STRIP_KEEP_ORIENTATION,
+// IMGAPI_EXTRACT_METADATA, IMGAPI_WATERMARK_ID
 func LoadFromEnv() Config {
 	addr := getEnvDefault("IMGAPI_ADDR", ":8080")
 	dataDir := getEnvDefault("IMGAPI_DATA_DIR", "./data/images")
@@ -23,7 +70,28 @@ func LoadFromEnv() Config {
 	return Config{
 		Addr:           addr,
 		DataDir:        dataDir,
+		Layout:         getEnvDefault("IMGAPI_LAYOUT", "flat"),
 		MaxUploadBytes: maxUploadMB * 1024 * 1024,
+		Storage:        getEnvDefault("IMGAPI_STORAGE", "file"),
+		S3: S3Config{
+			Endpoint:  os.Getenv("IMGAPI_S3_ENDPOINT"),
+			Bucket:    os.Getenv("IMGAPI_S3_BUCKET"),
+			Region:    getEnvDefault("IMGAPI_S3_REGION", "us-east-1"),
+			AccessKey: getEnvDefault("IMGAPI_S3_ACCESS_KEY", os.Getenv("AWS_ACCESS_KEY_ID")),
+			SecretKey: getEnvDefault("IMGAPI_S3_SECRET_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			Prefix:    os.Getenv("IMGAPI_S3_PREFIX"),
+		},
+		ContentAddressed: boolFromEnv("IMGAPI_CONTENT_ADDRESSED", false),
+		CacheDir:         os.Getenv("IMGAPI_CACHE_DIR"),
+		CacheMaxBytes:    int64FromEnv("IMGAPI_CACHE_MAX_MB", 512) * 1024 * 1024,
+		CacheControl:     getEnvDefault("IMGAPI_CACHE_CONTROL", "public, max-age=86400"),
+
+		StripMetadata:        boolFromEnv("IMGAPI_STRIP_METADATA", false),
+		StripKeepICC:         boolFromEnv("IMGAPI_STRIP_KEEP_ICC", true),
+		StripKeepOrientation: boolFromEnv("IMGAPI_STRIP_KEEP_ORIENTATION", true),
+		ExtractMetadata:      boolFromEnv("IMGAPI_EXTRACT_METADATA", false),
+
+		Watermark: os.Getenv("IMGAPI_WATERMARK_ID"),
 	}
 }
 
@@ -57,3 +125,16 @@ func int64FromEnv(key string, def int64) int64 {
 	}
 	return def
 }
+
+// boolFromEnv accepts 1/true/yes/on and 0/false/no/off (case-insensitive);
+// anything else yields def.
+func boolFromEnv(key string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	default:
+		return def
+	}
+}
@@ -3,12 +3,18 @@ package httpapi
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nsarup/imgapi/internal/processing"
+	"github.com/nsarup/imgapi/internal/service"
 	"github.com/nsarup/imgapi/pkg/api"
 )
 
@@ -17,66 +23,254 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	_, _ = io.WriteString(w, "ok")
 }
 
-// handleImages handles POST /images for uploads.
+// handleStats handles GET /debug/vars. It serves only the service counters,
+// in the expvar layout, rather than the full expvar dump with memory
+// statistics and the command line.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]service.Stats{"imgapi": s.svc.Stats()})
+}
+
+// handleImages handles POST /images for uploads and GET /images for listing.
 func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
 		s.handleUpload(w, r)
+	case http.MethodGet:
+		s.handleList(w, r)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// handleUpload streams the request body (raw or the multipart "file" field)
+// straight into storage without buffering it in memory.
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	var (
-		data     []byte
+		body     io.Reader
 		filename string
-		err      error
 	)
 
 	ct := r.Header.Get("Content-Type")
 	if strings.HasPrefix(ct, "multipart/form-data") {
-		if err := r.ParseMultipartForm(s.cfg.MaxUploadBytes); err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
-		}
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			writeError(w, http.StatusBadRequest, errors.New("missing file field"))
-			return
-		}
-		defer file.Close()
-		data, err = processing.CopyLimit(file, s.cfg.MaxUploadBytes)
+		mr, err := r.MultipartReader()
 		if err != nil {
-			writeError(w, http.StatusRequestEntityTooLarge, err)
+			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		if header != nil {
-			filename = header.Filename
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				writeError(w, http.StatusBadRequest, errors.New("missing file field"))
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if part.FormName() == "file" {
+				defer part.Close()
+				body, filename = part, part.FileName()
+				break
+			}
+			part.Close()
 		}
 	} else {
-		data, err = processing.CopyLimit(r.Body, s.cfg.MaxUploadBytes)
-		if err != nil {
-			writeError(w, http.StatusRequestEntityTooLarge, err)
-			return
-		}
+		body = r.Body
 		filename = r.Header.Get("X-Filename")
 	}
 
-	id, err := s.svc.SaveImage(data, filename)
+	id, err := s.svc.SaveImage(body, filename, s.cfg.MaxUploadBytes)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, processing.ErrTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeError(w, status, err)
 		return
 	}
 	writeJSON(w, http.StatusOK, api.UploadResponse{ID: id})
 }
 
-// handleGetImage handles GET /images/{id}[.{ext}] with optional Accept negotiation.
-func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// handleList handles GET /images?limit=&cursor= returning a page of images.
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a positive integer"))
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+	images, next, err := s.svc.ListImages(q.Get("cursor"), limit)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	resp := api.ListResponse{Images: make([]api.ImageInfo, 0, len(images)), NextCursor: next}
+	for _, img := range images {
+		resp.Images = append(resp.Images, api.ImageInfo{
+			ID:         img.ID,
+			Size:       img.Size,
+			Format:     img.Format,
+			Width:      img.Width,
+			Height:     img.Height,
+			UploadedAt: img.UploadedAt.UTC(),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleImage dispatches requests on /images/{id} and its sub-resources.
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	tail := strings.Trim(strings.TrimPrefix(r.URL.Path, "/images/"), "/")
+	if id, sub, ok := strings.Cut(tail, "/"); ok {
+		switch {
+		case sub == "meta" && r.Method == http.MethodGet:
+			s.handleGetMeta(w, r, id)
+		case sub == "exif" && r.Method == http.MethodGet:
+			s.handleGetExif(w, r, id)
+		case sub == "focal" && r.Method == http.MethodPut:
+			s.handlePutFocal(w, r, id)
+		case sub == "focal" && r.Method == http.MethodDelete:
+			s.handleDeleteFocal(w, r, id)
+		case sub == "meta" || sub == "exif" || sub == "focal":
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleGetImage(w, r)
+	case http.MethodDelete:
+		s.handleDeleteImage(w, r)
+	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeleteImage handles DELETE /images/{id}.
+func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	tail := strings.TrimPrefix(r.URL.Path, "/images/")
+	if tail == "" || tail == "/" {
+		http.NotFound(w, r)
 		return
 	}
+	id, _ := splitIDExt(tail)
+	if err := s.svc.DeleteImage(id); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetMeta handles GET /images/{id}/meta.
+func (s *Server) handleGetMeta(w http.ResponseWriter, r *http.Request, id string) {
+	meta, err := s.svc.ImageMeta(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	resp := api.ImageMetadata{
+		ID:          meta.ID,
+		Filename:    meta.Filename,
+		ContentType: meta.ContentType,
+		Format:      meta.Format,
+		Size:        meta.Size,
+		Width:       meta.Width,
+		Height:      meta.Height,
+		SHA256:      meta.SHA256,
+		UploadedAt:  meta.UploadedAt,
+		Stripped:    meta.Stripped,
+	}
+	if meta.Focal != nil {
+		resp.Focal = &api.FocalPoint{X: meta.Focal.X, Y: meta.Focal.Y}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// maxFocalBody bounds the JSON body of PUT /images/{id}/focal.
+const maxFocalBody = 1 << 10
+
+// handlePutFocal handles PUT /images/{id}/focal with a body of {"x":..,"y":..}.
+func (s *Server) handlePutFocal(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		X, Y *float64
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFocalBody)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.X == nil || body.Y == nil {
+		writeError(w, http.StatusBadRequest, errors.New("focal point needs x and y"))
+		return
+	}
+	fp := processing.FocalPoint{X: *body.X, Y: *body.Y}
+	if !fp.Valid() {
+		writeError(w, http.StatusBadRequest, errors.New("focal point must be x,y between 0 and 1"))
+		return
+	}
+	if err := s.svc.SetFocalPoint(id, &fp); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.FocalPoint{X: fp.X, Y: fp.Y})
+}
+
+// handleDeleteFocal handles DELETE /images/{id}/focal.
+func (s *Server) handleDeleteFocal(w http.ResponseWriter, r *http.Request, id string) {
+	if err := s.svc.SetFocalPoint(id, nil); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetExif handles GET /images/{id}/exif.
+func (s *Server) handleGetExif(w http.ResponseWriter, r *http.Request, id string) {
+	em, err := s.svc.EmbeddedMetadata(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	resp := api.EmbeddedMetadata{
+		CaptureTime:  em.CaptureTime,
+		Make:         em.Make,
+		Model:        em.Model,
+		LensModel:    em.LensModel,
+		Software:     em.Software,
+		Orientation:  em.Orientation,
+		ExposureTime: em.ExposureTime,
+		FNumber:      em.FNumber,
+		ISO:          em.ISO,
+		FocalLength:  em.FocalLength,
+		Artist:       em.Artist,
+		Copyright:    em.Copyright,
+		Title:        em.Title,
+		Description:  em.Description,
+		Keywords:     em.Keywords,
+	}
+	if em.GPS != nil {
+		resp.GPS = &api.GPS{Latitude: em.GPS.Latitude, Longitude: em.GPS.Longitude, Altitude: em.GPS.Altitude}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetImage handles GET and HEAD /images/{id}[.{ext}] with optional
+// Accept negotiation. Untransformed originals support Range requests.
+func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
 	// path after /images/
 	tail := strings.TrimPrefix(r.URL.Path, "/images/")
 	if tail == "" || tail == "/" {
@@ -86,31 +280,72 @@ func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
 	id, ext := splitIDExt(tail)
 	target := ""
 	if ext != "" {
-		switch strings.ToLower(ext) {
-		case "jpg", "jpeg":
-			target = string(processing.FormatJPEG)
-		case "png":
-			target = string(processing.FormatPNG)
-		default:
+		f, ok := formatForExt(ext)
+		if !ok {
 			http.Error(w, "unsupported format", http.StatusBadRequest)
 			return
 		}
+		target = string(f)
 	} else {
-		// Accept negotiation only when no extension supplied
-		accept := r.Header.Get("Accept")
-		if strings.Contains(accept, "image/jpeg") || strings.Contains(accept, "image/jpg") {
-			target = string(processing.FormatJPEG)
-		} else if strings.Contains(accept, "image/png") {
-			target = string(processing.FormatPNG)
+		// Accept negotiation only when no extension supplied; shared caches
+		// must then key the response on Accept too
+		w.Header().Add("Vary", "Accept")
+		target = string(formatForAccept(r.Header.Get("Accept")))
+	}
+
+	opts, err := parseOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts.Target = processing.SupportedFormat(target)
+
+	etag, modTime, err := s.svc.Validators(id, opts)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	setValidators(w, etag, modTime, s.cfg.CacheControl)
+	if notModified(r, etag, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if opts.IsNoop() {
+		// Originals are streamed from the store; ServeContent handles Range,
+		// If-Range and HEAD without reading more than it sends.
+		orig, err := s.svc.OpenOriginal(id)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
 		}
+		defer orig.Close()
+		w.Header().Set("Content-Type", orig.ContentType)
+		setDimensions(w, orig.Width, orig.Height)
+		http.ServeContent(w, r, "", modTime, orig)
+		return
 	}
 
-	// parse processing options
-	q := r.URL.Query()
-	opts := processing.Options{}
-	if target != "" {
-		opts.Target = processing.SupportedFormat(target)
+	b, ct, err := s.svc.GetImageWithOptions(id, opts)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if width, height, err := processing.Dimensions(b); err == nil {
+		setDimensions(w, width, height)
 	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(b)
+	}
+}
+
+// parseOptions reads the processing options from the query string. The output
+// format comes from the path or Accept header and is set by the caller.
+func parseOptions(q url.Values) (processing.Options, error) {
+	var opts processing.Options
 	if v := q.Get("quality"); v != "" {
 		opts.Quality = processing.ParseInt(v)
 	}
@@ -126,19 +361,218 @@ func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
 	if processing.ParseBool(q.Get("thumb")) || processing.ParseBool(q.Get("thumbnail")) {
 		opts.Thumbnail = true
 	}
+	opts.Fit = strings.ToLower(q.Get("fit"))
+	if v := q.Get("gravity"); v != "" {
+		g, err := processing.ParseGravity(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Gravity = g
+	}
+	if v := q.Get("fp"); v != "" {
+		fp, err := processing.ParseFocalPoint(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Focal = &fp
+	}
+	if v := q.Get("colors"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, errors.New("invalid colors")
+		}
+		opts.Colors = n
+	}
+	if v := q.Get("dither"); v != "" {
+		opts.NoDither = !processing.ParseBool(v)
+	}
+	opts.Compression = strings.ToLower(q.Get("compression"))
+	if v := q.Get("frame"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, errors.New("frame must be a positive integer")
+		}
+		opts.Frame = n
+	}
+	if v := q.Get("orient"); v != "" {
+		opts.NoOrient = !processing.ParseBool(v)
+	}
+	if v := q.Get("crop"); v != "" {
+		c, err := processing.ParseCrop(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Crop = c
+	}
+	if v := q.Get("rotate"); v != "" {
+		deg, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, errors.New("rotate must be a number of degrees")
+		}
+		opts.Rotate = deg
+	}
+	switch v := strings.ToLower(q.Get("flip")); v {
+	case "":
+	case "h", "v", "hv", "vh":
+		opts.FlipH = strings.Contains(v, "h")
+		opts.FlipV = strings.Contains(v, "v")
+	default:
+		return opts, errors.New("flip must be h, v or hv")
+	}
+	if v := q.Get("bg"); v != "" {
+		c, err := processing.ParseColor(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Background = c
+	}
+	for _, f := range []struct {
+		name string
+		dst  *float64
+	}{
+		{"brightness", &opts.Brightness},
+		{"contrast", &opts.Contrast},
+		{"gamma", &opts.Gamma},
+		{"saturation", &opts.Saturation},
+		{"hue", &opts.Hue},
+		{"sepia", &opts.Sepia},
+		{"blur", &opts.Blur},
+		{"sharpen", &opts.Sharpen},
+	} {
+		if v := q.Get(f.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be a number", f.name)
+			}
+			*f.dst = n
+		}
+	}
+	opts.Invert = processing.ParseBool(q.Get("invert"))
+	if v := q.Get("wm"); v != "" {
+		wm, err := parseWatermark(v, q)
+		if err != nil {
+			return opts, err
+		}
+		opts.Watermark = wm
+	}
+	return opts, opts.Validate()
+}
 
-	b, ct, err := s.svc.GetImageWithOptions(id, opts)
-	if err != nil {
-		status := http.StatusInternalServerError
-		if strings.Contains(err.Error(), "no such file") || strings.Contains(err.Error(), "not exist") {
-			status = http.StatusNotFound
+// parseWatermark reads the wm_* parameters of the watermark with image ID id
+// (or service.DefaultWatermark).
+func parseWatermark(id string, q url.Values) (*processing.Watermark, error) {
+	wm := &processing.Watermark{
+		ID:      id,
+		Gravity: processing.DefaultWatermarkGravity,
+		Scale:   processing.DefaultWatermarkScale,
+		Opacity: 1,
+		Tile:    processing.ParseBool(q.Get("wm_tile")),
+	}
+	if v := q.Get("wm_pos"); v != "" {
+		g, err := processing.ParseGravity(v)
+		if err != nil {
+			return nil, err
 		}
-		writeError(w, status, err)
-		return
+		wm.Gravity = g
+	}
+	if v := q.Get("wm_margin"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("wm_margin must be a number of pixels")
+		}
+		wm.Margin = n
+	}
+	for _, f := range []struct {
+		name string
+		dst  *float64
+	}{
+		{"wm_scale", &wm.Scale},
+		{"wm_opacity", &wm.Opacity},
+	} {
+		if v := q.Get(f.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", f.name)
+			}
+			*f.dst = n
+		}
+	}
+	return wm, nil
+}
+
+// formatForExt maps a URL extension to an output format.
+func formatForExt(ext string) (processing.SupportedFormat, bool) {
+	switch strings.ToLower(ext) {
+	case "jpg", "jpeg":
+		return processing.FormatJPEG, true
+	case "png":
+		return processing.FormatPNG, true
+	case "gif":
+		return processing.FormatGIF, true
+	case "bmp":
+		return processing.FormatBMP, true
+	case "tif", "tiff":
+		return processing.FormatTIFF, true
+	}
+	return "", false
+}
+
+// formatForAccept picks the first output format, in order of preference, that
+// the Accept header names explicitly. Wildcards keep the original format.
+func formatForAccept(accept string) processing.SupportedFormat {
+	switch {
+	case strings.Contains(accept, "image/jpeg") || strings.Contains(accept, "image/jpg"):
+		return processing.FormatJPEG
+	case strings.Contains(accept, "image/png"):
+		return processing.FormatPNG
+	case strings.Contains(accept, "image/gif"):
+		return processing.FormatGIF
+	case strings.Contains(accept, "image/bmp"):
+		return processing.FormatBMP
+	case strings.Contains(accept, "image/tiff"):
+		return processing.FormatTIFF
+	}
+	return ""
+}
+
+// setDimensions advertises the pixel size of the response body.
+func setDimensions(w http.ResponseWriter, width, height int) {
+	if width > 0 && height > 0 {
+		w.Header().Set("X-Image-Width", strconv.Itoa(width))
+		w.Header().Set("X-Image-Height", strconv.Itoa(height))
+	}
+}
+
+// setValidators sets the caching headers shared by image responses.
+func setValidators(w http.ResponseWriter, etag string, modTime time.Time, cacheControl string) {
+	h := w.Header()
+	h.Set("ETag", etag)
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if cacheControl != "" {
+		h.Set("Cache-Control", cacheControl)
 	}
-	w.Header().Set("Content-Type", ct)
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(b)
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since only
+// when no entity tags were sent (RFC 9110, section 13.2.2).
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !modTime.Truncate(time.Second).After(t)
+		}
+	}
+	return false
 }
 
 func splitIDExt(p string) (string, string) {
@@ -150,6 +584,17 @@ func splitIDExt(p string) (string, string) {
 	return base[:dot], base[dot+1:]
 }
 
+// errorStatus maps service errors to HTTP status codes.
+func errorStatus(err error) int {
+	if errors.Is(err, os.ErrNotExist) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, processing.ErrInvalidOption) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -2,23 +2,39 @@ package httpapi_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/nsarup/imgapi/internal/cache"
 	"github.com/nsarup/imgapi/internal/config"
 	"github.com/nsarup/imgapi/internal/httpapi"
 	"github.com/nsarup/imgapi/internal/logging"
+	"github.com/nsarup/imgapi/internal/processing"
 	"github.com/nsarup/imgapi/internal/service"
 	"github.com/nsarup/imgapi/internal/storage"
+	"github.com/nsarup/imgapi/pkg/api"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
-func newTestServer(t *testing.T) http.Handler {
+func newTestServer(t *testing.T, opts ...service.Option) http.Handler {
 	t.Helper()
 	cfg := config.LoadFromEnv()
 	cfg.DataDir = t.TempDir()
@@ -28,7 +44,7 @@ func newTestServer(t *testing.T) http.Handler {
 	if err != nil {
 		t.Fatalf("storage: %v", err)
 	}
-	svc := service.New(store)
+	svc := service.New(store, opts...)
 	return httpapi.NewServer(cfg, log, svc).Handler()
 }
 
@@ -121,3 +137,1304 @@ func TestGetWithAcceptHeader(t *testing.T) {
 		t.Fatalf("unexpected content-type: %s", ct)
 	}
 }
+
+func upload(t *testing.T, h http.Handler, data []byte, filename string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set("X-Filename", filename)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload status=%d body=%s", w.Code, w.Body.String())
+	}
+	var ur uploadResp
+	if err := json.Unmarshal(w.Body.Bytes(), &ur); err != nil {
+		t.Fatalf("bad json: %v", err)
+	}
+	return ur.ID
+}
+
+func TestDeleteImage(t *testing.T) {
+	h := newTestServer(t)
+	id := upload(t, h, makePNG(t, 2, 2), "x.png")
+
+	dr := httptest.NewRequest(http.MethodDelete, "/images/"+id, nil)
+	dw := httptest.NewRecorder()
+	h.ServeHTTP(dw, dr)
+	if dw.Code != http.StatusNoContent {
+		t.Fatalf("delete status=%d body=%s", dw.Code, dw.Body.String())
+	}
+
+	gw := httptest.NewRecorder()
+	h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, "/images/"+id, nil))
+	if gw.Code != http.StatusNotFound {
+		t.Fatalf("get after delete status=%d", gw.Code)
+	}
+
+	dw = httptest.NewRecorder()
+	h.ServeHTTP(dw, httptest.NewRequest(http.MethodDelete, "/images/"+id, nil))
+	if dw.Code != http.StatusNotFound {
+		t.Fatalf("second delete status=%d", dw.Code)
+	}
+}
+
+func TestListImagesPagination(t *testing.T) {
+	h := newTestServer(t)
+	want := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		want[upload(t, h, makePNG(t, 3, 2), "x.png")] = true
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		lw := httptest.NewRecorder()
+		h.ServeHTTP(lw, httptest.NewRequest(http.MethodGet, "/images?limit=2&cursor="+cursor, nil))
+		if lw.Code != http.StatusOK {
+			t.Fatalf("list status=%d body=%s", lw.Code, lw.Body.String())
+		}
+		var lr api.ListResponse
+		if err := json.Unmarshal(lw.Body.Bytes(), &lr); err != nil {
+			t.Fatalf("bad json: %v", err)
+		}
+		if len(lr.Images) > 2 {
+			t.Fatalf("page too large: %d", len(lr.Images))
+		}
+		for _, img := range lr.Images {
+			if img.Format != "png" || img.Width != 3 || img.Height != 2 || img.Size == 0 {
+				t.Fatalf("unexpected entry: %+v", img)
+			}
+			seen[img.ID] = true
+		}
+		if lr.NextCursor == "" {
+			break
+		}
+		cursor = lr.NextCursor
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("listed %d images, want %d", len(seen), len(want))
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Fatalf("missing %s", id)
+		}
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	h := newTestServer(t)
+	pngBytes := makePNG(t, 5, 3)
+	id := upload(t, h, pngBytes, "holiday.png")
+
+	mw := httptest.NewRecorder()
+	h.ServeHTTP(mw, httptest.NewRequest(http.MethodGet, "/images/"+id+"/meta", nil))
+	if mw.Code != http.StatusOK {
+		t.Fatalf("meta status=%d body=%s", mw.Code, mw.Body.String())
+	}
+	var meta api.ImageMetadata
+	if err := json.Unmarshal(mw.Body.Bytes(), &meta); err != nil {
+		t.Fatalf("bad json: %v", err)
+	}
+	sum := sha256.Sum256(pngBytes)
+	if meta.ID != id || meta.Filename != "holiday.png" || meta.ContentType != "image/png" ||
+		meta.Format != "png" || meta.Size != int64(len(pngBytes)) || meta.Width != 5 || meta.Height != 3 ||
+		meta.SHA256 != hex.EncodeToString(sum[:]) || meta.UploadedAt.IsZero() {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	nw := httptest.NewRecorder()
+	h.ServeHTTP(nw, httptest.NewRequest(http.MethodGet, "/images/doesnotexist/meta", nil))
+	if nw.Code != http.StatusNotFound {
+		t.Fatalf("missing meta status=%d", nw.Code)
+	}
+}
+
+func TestUploadTooLargeLeavesNothing(t *testing.T) {
+	h := newTestServer(t)
+	big := bytes.Repeat([]byte{0xAB}, 5*1024*1024+1)
+	r := httptest.NewRequest(http.MethodPost, "/images", bytes.NewReader(big))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	lw := httptest.NewRecorder()
+	h.ServeHTTP(lw, httptest.NewRequest(http.MethodGet, "/images", nil))
+	var lr api.ListResponse
+	if err := json.Unmarshal(lw.Body.Bytes(), &lr); err != nil {
+		t.Fatalf("bad json: %v", err)
+	}
+	if len(lr.Images) != 0 {
+		t.Fatalf("partial upload left behind: %+v", lr.Images)
+	}
+}
+
+func TestUploadMultipartStreams(t *testing.T) {
+	h := newTestServer(t)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("note", "ignored")
+	fw, err := mw.CreateFormFile("file", "parrot.png")
+	if err != nil {
+		t.Fatalf("form file: %v", err)
+	}
+	_, _ = fw.Write(makePNG(t, 6, 4))
+	_ = mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/images", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload status=%d body=%s", w.Code, w.Body.String())
+	}
+	var ur uploadResp
+	_ = json.Unmarshal(w.Body.Bytes(), &ur)
+
+	mr := httptest.NewRecorder()
+	h.ServeHTTP(mr, httptest.NewRequest(http.MethodGet, "/images/"+ur.ID+"/meta", nil))
+	var meta api.ImageMetadata
+	if err := json.Unmarshal(mr.Body.Bytes(), &meta); err != nil {
+		t.Fatalf("bad json: %v", err)
+	}
+	if meta.Filename != "parrot.png" || meta.Width != 6 || meta.Height != 4 {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+}
+
+func TestDuplicateUploadKeepsCachedVariants(t *testing.T) {
+	c, err := cache.NewDisk(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("cache: %v", err)
+	}
+	cfg := config.LoadFromEnv()
+	cfg.DataDir = t.TempDir()
+	store, err := storage.NewFileStore(cfg.DataDir, storage.WithContentAddressing())
+	if err != nil {
+		t.Fatalf("storage: %v", err)
+	}
+	h := httpapi.NewServer(cfg, logging.New(io.Discard), service.New(store, service.WithCache(c))).Handler()
+	id := upload(t, h, makePNG(t, 8, 8), "x.png")
+
+	gw := httptest.NewRecorder()
+	h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, "/images/"+id+".jpg?w=4", nil))
+	if gw.Code != http.StatusOK || c.Size() == 0 {
+		t.Fatalf("get status=%d, cached %d bytes", gw.Code, c.Size())
+	}
+	if dup := upload(t, h, makePNG(t, 8, 8), "y.png"); dup != id {
+		t.Fatalf("duplicate upload id = %s, want %s", dup, id)
+	}
+	if c.Size() == 0 {
+		t.Fatal("duplicate upload dropped the cached variant")
+	}
+}
+
+func TestDerivativeCacheInvalidatedOnDelete(t *testing.T) {
+	c, err := cache.NewDisk(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("cache: %v", err)
+	}
+	h := newTestServer(t, service.WithCache(c))
+	id := upload(t, h, makePNG(t, 8, 8), "x.png")
+
+	var first []byte
+	for i := 0; i < 2; i++ {
+		gw := httptest.NewRecorder()
+		h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, "/images/"+id+".jpg?w=4", nil))
+		if gw.Code != http.StatusOK {
+			t.Fatalf("get status=%d body=%s", gw.Code, gw.Body.String())
+		}
+		if i == 0 {
+			first = gw.Body.Bytes()
+		} else if !bytes.Equal(first, gw.Body.Bytes()) {
+			t.Fatal("cached variant differs from processed one")
+		}
+	}
+	if c.Size() == 0 {
+		t.Fatal("variant was not cached")
+	}
+
+	dw := httptest.NewRecorder()
+	h.ServeHTTP(dw, httptest.NewRequest(http.MethodDelete, "/images/"+id, nil))
+	if dw.Code != http.StatusNoContent {
+		t.Fatalf("delete status=%d", dw.Code)
+	}
+	if c.Size() != 0 {
+		t.Fatalf("cache still holds %d bytes after delete", c.Size())
+	}
+	gw := httptest.NewRecorder()
+	h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, "/images/"+id+".jpg?w=4", nil))
+	if gw.Code != http.StatusNotFound {
+		t.Fatalf("get after delete status=%d", gw.Code)
+	}
+}
+
+func TestETagAndConditionalGet(t *testing.T) {
+	h := newTestServer(t)
+	pngBytes := makePNG(t, 4, 4)
+	id := upload(t, h, pngBytes, "x.png")
+
+	gw := httptest.NewRecorder()
+	h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, "/images/"+id, nil))
+	sum := sha256.Sum256(pngBytes)
+	etag := gw.Header().Get("ETag")
+	if etag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Fatalf("original etag = %s", etag)
+	}
+	lastMod := gw.Header().Get("Last-Modified")
+	if lastMod == "" || gw.Header().Get("Cache-Control") == "" {
+		t.Fatalf("missing caching headers: %v", gw.Header())
+	}
+	// the representation of an extension-less URL depends on Accept
+	if v := gw.Header().Get("Vary"); v != "Accept" {
+		t.Fatalf("Vary = %q, want Accept", v)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/images/"+id, nil)
+	r.Header.Set("If-None-Match", etag)
+	cw := httptest.NewRecorder()
+	h.ServeHTTP(cw, r)
+	if cw.Code != http.StatusNotModified || cw.Body.Len() != 0 {
+		t.Fatalf("If-None-Match status=%d len=%d", cw.Code, cw.Body.Len())
+	}
+	if cw.Header().Get("Vary") != "Accept" {
+		t.Fatalf("304 without Vary: %v", cw.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/images/"+id, nil)
+	r.Header.Set("If-Modified-Since", lastMod)
+	cw = httptest.NewRecorder()
+	h.ServeHTTP(cw, r)
+	if cw.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since status=%d", cw.Code)
+	}
+
+	// a derivative has its own validator, stable across requests
+	dw := httptest.NewRecorder()
+	h.ServeHTTP(dw, httptest.NewRequest(http.MethodGet, "/images/"+id+".jpg?w=2", nil))
+	detag := dw.Header().Get("ETag")
+	if detag == "" || detag == etag {
+		t.Fatalf("derivative etag = %s", detag)
+	}
+	if v := dw.Header().Get("Vary"); v != "" {
+		t.Fatalf("Vary = %q on a URL with an extension", v)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/images/"+id+".jpg?w=2", nil)
+	r.Header.Set("If-None-Match", `"other", `+detag)
+	cw = httptest.NewRecorder()
+	h.ServeHTTP(cw, r)
+	if cw.Code != http.StatusNotModified {
+		t.Fatalf("derivative If-None-Match status=%d", cw.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/images/"+id+".jpg?w=3", nil)
+	r.Header.Set("If-None-Match", detag)
+	cw = httptest.NewRecorder()
+	h.ServeHTTP(cw, r)
+	if cw.Code != http.StatusOK {
+		t.Fatalf("mismatched etag status=%d", cw.Code)
+	}
+}
+
+func TestRangeRequestsOnOriginal(t *testing.T) {
+	h := newTestServer(t)
+	pngBytes := makePNG(t, 8, 8)
+	id := upload(t, h, pngBytes, "x.png")
+
+	r := httptest.NewRequest(http.MethodGet, "/images/"+id, nil)
+	r.Header.Set("Range", "bytes=0-7")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), pngBytes[:8]) {
+		t.Fatalf("range status=%d body=%x", w.Code, w.Body.Bytes())
+	}
+	if w.Header().Get("Accept-Ranges") != "bytes" || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("unexpected headers: %v", w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/images/"+id, nil)
+	r.Header.Set("Range", "bytes=0-1,4-5")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("multi-range status=%d content-type=%s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// a stale If-Range validator yields the full representation
+	r = httptest.NewRequest(http.MethodGet, "/images/"+id, nil)
+	r.Header.Set("Range", "bytes=0-7")
+	r.Header.Set("If-Range", `"stale"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), pngBytes) {
+		t.Fatalf("If-Range mismatch status=%d len=%d", w.Code, w.Body.Len())
+	}
+}
+
+func TestHeadMatchesGetHeaders(t *testing.T) {
+	h := newTestServer(t)
+	pngBytes := makePNG(t, 6, 3)
+	id := upload(t, h, pngBytes, "x.png")
+
+	for _, p := range []string{"/images/" + id, "/images/" + id + ".jpg?w=4"} {
+		gw := httptest.NewRecorder()
+		h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, p, nil))
+		hw := httptest.NewRecorder()
+		h.ServeHTTP(hw, httptest.NewRequest(http.MethodHead, p, nil))
+		if hw.Code != http.StatusOK || hw.Body.Len() != 0 {
+			t.Fatalf("HEAD %s status=%d body=%d bytes", p, hw.Code, hw.Body.Len())
+		}
+		if want := strconv.Itoa(gw.Body.Len()); gw.Header().Get("Content-Length") != want || hw.Header().Get("Content-Length") != want {
+			t.Fatalf("%s content-length GET=%s HEAD=%s want %s", p,
+				gw.Header().Get("Content-Length"), hw.Header().Get("Content-Length"), want)
+		}
+		for _, k := range []string{"Content-Type", "ETag", "X-Image-Width", "X-Image-Height"} {
+			if hw.Header().Get(k) == "" || hw.Header().Get(k) != gw.Header().Get(k) {
+				t.Fatalf("%s header %s: HEAD=%q GET=%q", p, k, hw.Header().Get(k), gw.Header().Get(k))
+			}
+		}
+	}
+
+	hw := httptest.NewRecorder()
+	h.ServeHTTP(hw, httptest.NewRequest(http.MethodHead, "/images/"+id, nil))
+	if hw.Header().Get("X-Image-Width") != "6" || hw.Header().Get("X-Image-Height") != "3" {
+		t.Fatalf("dimensions = %sx%s", hw.Header().Get("X-Image-Width"), hw.Header().Get("X-Image-Height"))
+	}
+	hw = httptest.NewRecorder()
+	h.ServeHTTP(hw, httptest.NewRequest(http.MethodHead, "/images/"+id+"?w=4", nil))
+	if hw.Header().Get("X-Image-Width") != "4" || hw.Header().Get("X-Image-Height") != "2" {
+		t.Fatalf("derivative dimensions = %sx%s", hw.Header().Get("X-Image-Width"), hw.Header().Get("X-Image-Height"))
+	}
+}
+
+// tinyWebP is a 1x1 lossless WebP.
+const tinyWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func encodeAs(t *testing.T, format string, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "bmp":
+		err = bmp.Encode(&buf, img)
+	case "tiff":
+		err = tiff.Encode(&buf, img, nil)
+	case "webp":
+		b, _ := base64.StdEncoding.DecodeString(tinyWebP)
+		return b
+	}
+	if err != nil {
+		t.Fatalf("encode %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestAdditionalInputFormats(t *testing.T) {
+	h := newTestServer(t)
+	src := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for _, format := range []string{"gif", "bmp", "tiff", "webp"} {
+		t.Run(format, func(t *testing.T) {
+			id := upload(t, h, encodeAs(t, format, src), "x."+format)
+
+			gw := httptest.NewRecorder()
+			h.ServeHTTP(gw, httptest.NewRequest(http.MethodGet, "/images/"+id, nil))
+			if ct := gw.Header().Get("Content-Type"); ct != "image/"+format {
+				t.Fatalf("original content-type = %s", ct)
+			}
+
+			for _, q := range []string{"?w=2", "?gray=1", "?w=2&h=2&thumb=1"} {
+				pw := httptest.NewRecorder()
+				h.ServeHTTP(pw, httptest.NewRequest(http.MethodGet, "/images/"+id+".png"+q, nil))
+				if pw.Code != http.StatusOK {
+					t.Fatalf("%s status=%d body=%s", q, pw.Code, pw.Body.String())
+				}
+				if _, err := png.Decode(bytes.NewReader(pw.Body.Bytes())); err != nil {
+					t.Fatalf("%s: output is not a PNG: %v", q, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLargeTIFFMetadata(t *testing.T) {
+	h := newTestServer(t)
+	// x/image/tiff writes the IFD after the pixel data, beyond the sniffed head
+	data := encodeAs(t, "tiff", image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	if len(data) <= 256<<10 {
+		t.Fatalf("fixture is only %d bytes", len(data))
+	}
+	id := upload(t, h, data, "big.tiff")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+"/meta", nil))
+	var meta api.ImageMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Format != "tiff" || meta.ContentType != "image/tiff" || meta.Width != 400 || meta.Height != 200 {
+		t.Fatalf("meta = %+v", meta)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id, nil))
+	if ct := w.Header().Get("Content-Type"); ct != "image/tiff" {
+		t.Fatalf("original content-type = %s", ct)
+	}
+}
+
+func TestAdditionalOutputFormats(t *testing.T) {
+	h := newTestServer(t)
+	src := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			src.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 128, 255})
+		}
+	}
+	id := upload(t, h, encodeAs(t, "png", src), "x.png")
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for _, tc := range []struct{ path, accept, ct string }{
+		{"/images/" + id + ".gif", "", "image/gif"},
+		{"/images/" + id + ".bmp", "", "image/bmp"},
+		{"/images/" + id + ".tif", "", "image/tiff"},
+		{"/images/" + id + ".tiff?compression=none", "", "image/tiff"},
+		{"/images/" + id, "image/gif", "image/gif"},
+		{"/images/" + id, "image/bmp", "image/bmp"},
+		{"/images/" + id, "image/tiff", "image/tiff"},
+	} {
+		w := get(tc.path, tc.accept)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tc.ct {
+			t.Fatalf("%s (Accept %q): status=%d ct=%s", tc.path, tc.accept, w.Code, w.Header().Get("Content-Type"))
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+		if err != nil || "image/"+format != tc.ct || cfg.Width != 16 || cfg.Height != 8 {
+			t.Fatalf("%s: decoded %s %dx%d, %v", tc.path, format, cfg.Width, cfg.Height, err)
+		}
+	}
+
+	// palette size bounds the GIF colour table
+	w := get("/images/"+id+".gif?colors=4&dither=0", "")
+	g, err := gif.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode gif: %v", err)
+	}
+	if n := len(g.(*image.Paletted).Palette); n > 4 {
+		t.Fatalf("palette has %d colours, want <= 4", n)
+	}
+
+	for _, q := range []string{"?colors=1", "?colors=300", "?colors=x", "?compression=lzw"} {
+		if w := get("/images/"+id+".gif"+q, ""); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestAnimatedGIF(t *testing.T) {
+	h := newTestServer(t)
+	pal := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}}
+	anim := &gif.GIF{LoopCount: 3}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 8, 8), pal)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	id := upload(t, h, buf.Bytes(), "anim.gif")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/images/" + id + "?w=4")
+	out, err := gif.DecodeAll(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode: %v (status %d)", err, w.Code)
+	}
+	if len(out.Image) != 3 || out.LoopCount != 3 {
+		t.Fatalf("frames=%d loop=%d", len(out.Image), out.LoopCount)
+	}
+	for i, f := range out.Image {
+		if f.Bounds().Dx() != 4 || out.Delay[i] != 10*(i+1) || out.Disposal[i] != gif.DisposalBackground {
+			t.Fatalf("frame %d: %v delay=%d disposal=%d", i, f.Bounds(), out.Delay[i], out.Disposal[i])
+		}
+	}
+	if r, _, _, _ := out.Image[2].At(1, 1).RGBA(); r>>8 != 255 {
+		t.Fatalf("third frame not red")
+	}
+
+	// frame=N extracts a single still
+	w = get("/images/" + id + ".png?frame=3")
+	still, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decode still: %v (status %d)", err, w.Code)
+	}
+	if r, g, _, _ := still.At(0, 0).RGBA(); r>>8 != 255 || g != 0 {
+		t.Fatalf("frame 3 pixel = %v", still.At(0, 0))
+	}
+	w = get("/images/" + id + "?frame=2")
+	if g, err := gif.DecodeAll(bytes.NewReader(w.Body.Bytes())); err != nil || len(g.Image) != 1 {
+		t.Fatalf("frame=2 as gif: %v", err)
+	}
+
+	for _, q := range []string{"?frame=0", "?frame=x", "?frame=4"} {
+		if w := get("/images/" + id + q); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestSmartGravityAnimated(t *testing.T) {
+	h := newTestServer(t)
+	grey, skin, shade := color.RGBA{128, 128, 128, 255}, color.RGBA{224, 160, 130, 255}, color.RGBA{180, 120, 90, 255}
+	pal := color.Palette{grey, skin, shade}
+	// a textured subject that moves from the left edge to the right edge
+	anim := &gif.GIF{}
+	for _, x0 := range []int{2, 28} {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 10), pal)
+		for y := 0; y < 10; y++ {
+			for x := x0; x < x0+10; x++ {
+				frame.SetColorIndex(x, y, uint8(1+(x+y)%2))
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	id := upload(t, h, buf.Bytes(), "anim.gif")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+".gif?w=10&h=10&fit=cover&gravity=smart", nil))
+	out, err := gif.DecodeAll(w.Body)
+	if err != nil || len(out.Image) != 2 {
+		t.Fatalf("decode: %v", err)
+	}
+	// with one window for the animation, the subject is in at most one frame
+	var withSubject int
+	for _, f := range out.Image {
+		r, g, b, _ := f.At(5, 5).RGBA()
+		if r != g || g != b {
+			withSubject++
+		}
+	}
+	if withSubject != 1 {
+		t.Fatalf("subject visible in %d of 2 frames, want the crop window fixed across frames", withSubject)
+	}
+}
+
+// withOrientation inserts an EXIF APP1 segment carrying only the Orientation
+// tag right after the JPEG SOI marker.
+func withOrientation(jpg []byte, orientation byte) []byte {
+	tiffData := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0, // little-endian header, IFD0 at 8
+		1, 0, // one entry
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, orientation, 0, 0, 0, // Orientation, SHORT, 1
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiffData...)
+	seg := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, seg...)
+	out = append(out, payload...)
+	return append(out, jpg[2:]...)
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	h := newTestServer(t)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	id := upload(t, h, withOrientation(buf.Bytes(), 6), "phone.jpg") // rotate 90° CW
+
+	size := func(path string) (int, int) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d", path, w.Code)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return cfg.Width, cfg.Height
+	}
+	if w, h := size("/images/" + id + ".png"); w != 4 || h != 8 {
+		t.Fatalf("auto-oriented size = %dx%d, want 4x8", w, h)
+	}
+	if w, h := size("/images/" + id + ".png?orient=0"); w != 8 || h != 4 {
+		t.Fatalf("orient=0 size = %dx%d, want 8x4", w, h)
+	}
+}
+
+type tiffField struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+	ifdRef   int // if > 0, the value is the offset of that IFD
+}
+
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: 2, count: uint32(len(s) + 1), data: []byte(s + "\x00")}
+}
+
+func rationalField(tag uint16, v ...uint32) tiffField {
+	f := tiffField{tag: tag, typ: 5, count: uint32(len(v) / 2)}
+	for _, x := range v {
+		f.data = binary.LittleEndian.AppendUint32(f.data, x)
+	}
+	return f
+}
+
+// tiffBlock lays out little-endian IFDs one after another, each followed by
+// its out-of-line values.
+func tiffBlock(ifds ...[]tiffField) []byte {
+	le := binary.LittleEndian
+	offs := make([]int, len(ifds))
+	off := 8
+	for i, fields := range ifds {
+		offs[i] = off
+		off += 2 + 12*len(fields) + 4
+		for _, f := range fields {
+			if len(f.data) > 4 {
+				off += len(f.data)
+			}
+		}
+	}
+	b := le.AppendUint32([]byte("II*\x00"), 8)
+	for i, fields := range ifds {
+		dataOff := offs[i] + 2 + 12*len(fields) + 4
+		var extra []byte
+		b = le.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = le.AppendUint16(b, f.tag)
+			b = le.AppendUint16(b, f.typ)
+			b = le.AppendUint32(b, f.count)
+			switch {
+			case f.ifdRef > 0:
+				b = le.AppendUint32(b, uint32(offs[f.ifdRef]))
+			case len(f.data) > 4:
+				b = le.AppendUint32(b, uint32(dataOff+len(extra)))
+				extra = append(extra, f.data...)
+			default:
+				v := make([]byte, 4)
+				copy(v, f.data)
+				b = append(b, v...)
+			}
+		}
+		b = le.AppendUint32(b, 0)
+		b = append(b, extra...)
+	}
+	return b
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	n := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(n >> 8), byte(n)}, payload...)
+}
+
+// taggedJPEG returns a JPEG carrying EXIF (with GPS), IPTC and XMP metadata.
+func taggedJPEG(t *testing.T) []byte {
+	t.Helper()
+	exif := tiffBlock(
+		[]tiffField{
+			asciiField(0x010F, "Canon"),
+			asciiField(0x0110, "Canon EOS R5"),
+			{tag: 0x0112, typ: 3, count: 1, data: []byte{1, 0}},
+			{tag: 0x8769, typ: 4, count: 1, ifdRef: 1},
+			{tag: 0x8825, typ: 4, count: 1, ifdRef: 2},
+		},
+		[]tiffField{
+			rationalField(0x829A, 1, 250),
+			rationalField(0x829D, 28, 10),
+			{tag: 0x8827, typ: 3, count: 1, data: []byte{200, 0}},
+			asciiField(0x9003, "2023:07:14 18:30:05"),
+			asciiField(0x9011, "+02:00"),
+		},
+		[]tiffField{
+			asciiField(1, "N"),
+			rationalField(2, 37, 1, 46, 1, 30, 1),
+			asciiField(3, "W"),
+			rationalField(4, 122, 1, 25, 1, 0, 1),
+		},
+	)
+	iptc := []byte("\x1c\x02\x50\x00\x08Jane Doe\x1c\x02\x19\x00\x06bridge\x1c\x02\x19\x00\x06sunset")
+	irb := append([]byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00"), byte(len(iptc)>>24), byte(len(iptc)>>16), byte(len(iptc)>>8), byte(len(iptc)))
+	irb = append(irb, iptc...)
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreateDate="2020-01-01T00:00:00">` +
+		`<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">(c) 2023 Jane Doe</rdf:li></rdf:Alt></dc:rights>` +
+		`<dc:subject><rdf:Bag><rdf:li>ignored</rdf:li></rdf:Bag></dc:subject>` +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	out := append([]byte{}, enc.Bytes()[:2]...)
+	out = append(out, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exif...))...)
+	out = append(out, jpegSegment(0xED, irb)...)
+	out = append(out, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"+xmp))...)
+	return append(out, enc.Bytes()[2:]...)
+}
+
+func TestGetExif(t *testing.T) {
+	want := api.EmbeddedMetadata{
+		CaptureTime:  "2023-07-14T18:30:05+02:00",
+		Make:         "Canon",
+		Model:        "Canon EOS R5",
+		Orientation:  1,
+		ExposureTime: "1/250",
+		FNumber:      2.8,
+		ISO:          200,
+		Artist:       "Jane Doe",
+		Copyright:    "(c) 2023 Jane Doe",
+		Keywords:     []string{"bridge", "sunset"},
+		GPS:          &api.GPS{Latitude: 37.775, Longitude: -122.416667},
+	}
+	getExif := func(t *testing.T, h http.Handler, id string) api.EmbeddedMetadata {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+"/exif", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+		}
+		var got api.EmbeddedMetadata
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("parsed on request", func(t *testing.T) {
+		h := newTestServer(t)
+		id := upload(t, h, taggedJPEG(t), "x.jpg")
+		if got := getExif(t, h, id); !reflect.DeepEqual(got, want) {
+			t.Fatalf("exif = %+v, want %+v", got, want)
+		}
+		if got := getExif(t, h, upload(t, h, makePNG(t, 2, 2), "x.png")); !reflect.DeepEqual(got, api.EmbeddedMetadata{}) {
+			t.Fatalf("png without metadata: %+v", got)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/missing/exif", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("missing image: status=%d", w.Code)
+		}
+	})
+
+	t.Run("extracted at upload before stripping", func(t *testing.T) {
+		h := newTestServer(t, service.WithMetadataExtraction(), service.WithMetadataStripping(processing.StripPolicy{}))
+		id := upload(t, h, taggedJPEG(t), "x.jpg")
+		redacted := want
+		redacted.Make, redacted.Model, redacted.GPS = "", "", nil
+		if got := getExif(t, h, id); !reflect.DeepEqual(got, redacted) {
+			t.Fatalf("exif = %+v, want %+v", got, redacted)
+		}
+	})
+
+	t.Run("extracted at upload past the sniffed head", func(t *testing.T) {
+		// a TIFF whose IFD, with Make and Artist, follows 300 KiB of pixel data
+		le := binary.LittleEndian
+		ifd := 8 + 300<<10
+		values := ifd + 2 + 2*12 + 4
+		b := le.AppendUint32([]byte("II*\x00"), uint32(ifd))
+		b = append(b, make([]byte, ifd-len(b))...)
+		b = le.AppendUint16(b, 2)
+		for _, f := range []struct {
+			tag      uint16
+			n, value int
+		}{{0x010F, 6, values}, {0x013B, 5, values + 6}} {
+			b = le.AppendUint16(b, f.tag)
+			b = le.AppendUint16(b, 2)
+			b = le.AppendUint32(b, uint32(f.n))
+			b = le.AppendUint32(b, uint32(f.value))
+		}
+		b = le.AppendUint32(b, 0)
+		b = append(b, "Canon\x00Jane\x00"...)
+
+		for _, tc := range []struct {
+			opts []service.Option
+			want api.EmbeddedMetadata
+		}{
+			{[]service.Option{service.WithMetadataExtraction()}, api.EmbeddedMetadata{Make: "Canon", Artist: "Jane"}},
+			{[]service.Option{service.WithMetadataExtraction(), service.WithMetadataStripping(processing.StripPolicy{})}, api.EmbeddedMetadata{Artist: "Jane"}},
+		} {
+			h := newTestServer(t, tc.opts...)
+			if got := getExif(t, h, upload(t, h, b, "x.tiff")); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("exif = %+v, want %+v", got, tc.want)
+			}
+		}
+	})
+}
+
+func TestCropRotateFlip(t *testing.T) {
+	h := newTestServer(t)
+	// 40x20, left half red, right half blue
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.NRGBA{255, 0, 0, 255}
+			if x >= 20 {
+				c = color.NRGBA{0, 0, 255, 255}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	id := upload(t, h, encodeAs(t, "png", src), "x.png")
+
+	get := func(q string) (image.Image, int) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+".png"+q, nil))
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return img, w.Code
+	}
+	isRed := func(c color.Color) bool { r, _, b, _ := c.RGBA(); return r > 0xf000 && b < 0x1000 }
+
+	for _, tc := range []struct {
+		q          string
+		w, h       int
+		topLeftRed bool
+	}{
+		{"?crop=25,5,10,10", 10, 10, false},
+		{"?crop=0,0,50%25,100%25", 20, 20, true},
+		{"?crop=30,0,20,20", 10, 20, false}, // clipped to the image
+		{"?rotate=90", 20, 40, true},
+		{"?rotate=-90", 20, 40, false},
+		{"?rotate=180", 40, 20, false},
+		{"?flip=h", 40, 20, false},
+		{"?flip=v", 40, 20, true},
+		{"?crop=0,0,20,20&rotate=90&flip=h", 20, 20, true},
+		// crop happens before resize
+		{"?crop=20,0,20,20&w=5", 5, 5, false},
+	} {
+		img, code := get(tc.q)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status=%d", tc.q, code)
+		}
+		if b := img.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Fatalf("%s: size %dx%d, want %dx%d", tc.q, b.Dx(), b.Dy(), tc.w, tc.h)
+		}
+		if got := isRed(img.At(0, 0)); got != tc.topLeftRed {
+			t.Fatalf("%s: top-left red=%v, want %v", tc.q, got, tc.topLeftRed)
+		}
+	}
+
+	// arbitrary angles grow the canvas and fill the corners with bg
+	img, _ := get("?rotate=45&bg=00ff00")
+	if b := img.Bounds(); b.Dx() <= 40 || b.Dy() <= 20 {
+		t.Fatalf("rotate=45 size %v", b)
+	}
+	if r, g, b, a := img.At(0, 0).RGBA(); r != 0 || g != 0xffff || b != 0 || a != 0xffff {
+		t.Fatalf("corner = %v, want bg", img.At(0, 0))
+	}
+
+	for _, q := range []string{"?crop=1,2,3", "?crop=0,0,0,10", "?crop=0,0,150%25,10", "?crop=50,50,10,10", "?rotate=abc", "?flip=x", "?bg=zzz"} {
+		if _, code := get(q); code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d, want 400", q, code)
+		}
+	}
+}
+
+func TestFitModes(t *testing.T) {
+	h := newTestServer(t)
+	// 40x20: left half red, right half blue
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				src.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+			} else {
+				src.SetNRGBA(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	id := upload(t, h, encodeAs(t, "png", src), "x.png")
+
+	get := func(q string) (image.Image, int) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+".png"+q, nil))
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return img, w.Code
+	}
+	rgba := func(c color.Color) color.NRGBA { return color.NRGBAModel.Convert(c).(color.NRGBA) }
+
+	for _, tc := range []struct {
+		q    string
+		w, h int
+	}{
+		{"?w=10&h=10", 10, 10},
+		{"?w=10&h=10&fit=fill", 10, 10},
+		{"?w=10&h=10&fit=cover", 10, 10},
+		{"?w=10&h=10&thumb=1", 10, 10},
+		{"?w=10&h=10&fit=contain", 10, 10},
+		{"?w=10&h=10&fit=inside", 10, 5},
+		{"?w=10&h=10&fit=outside", 20, 10},
+		{"?w=80&h=80&fit=pad", 80, 80},
+		{"?w=80&h=80&fit=inside", 80, 40},
+		{"?w=10&fit=cover", 10, 5},
+	} {
+		img, code := get(tc.q)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status=%d", tc.q, code)
+		}
+		if b := img.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Fatalf("%s: size %dx%d, want %dx%d", tc.q, b.Dx(), b.Dy(), tc.w, tc.h)
+		}
+	}
+
+	// cover crops the centre by default
+	if img, _ := get("?w=10&h=10&fit=cover"); rgba(img.At(0, 5)).R < 200 || rgba(img.At(9, 5)).B < 200 {
+		t.Fatalf("centre cover = %v ... %v", rgba(img.At(0, 5)), rgba(img.At(9, 5)))
+	}
+	// gravity picks the part kept by cover crops
+	if img, _ := get("?w=10&h=10&fit=cover&gravity=w"); rgba(img.At(9, 5)).R < 200 {
+		t.Fatalf("gravity=w kept %v", rgba(img.At(9, 5)))
+	}
+	if img, _ := get("?w=10&h=10&fit=cover&gravity=east"); rgba(img.At(0, 5)).B < 200 {
+		t.Fatalf("gravity=east kept %v", rgba(img.At(0, 5)))
+	}
+	// contain letterboxes with bg; pad keeps the original size at the gravity
+	img, _ := get("?w=10&h=10&fit=contain&bg=00ff00")
+	if c := rgba(img.At(5, 0)); c != (color.NRGBA{0, 255, 0, 255}) {
+		t.Fatalf("contain padding = %v", c)
+	}
+	img, _ = get("?w=80&h=80&fit=pad&gravity=nw&bg=fff")
+	if c := rgba(img.At(0, 0)); c.R != 255 || c.G != 0 {
+		t.Fatalf("pad top-left = %v, want image", c)
+	}
+	if c := rgba(img.At(79, 79)); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Fatalf("pad bottom-right = %v, want bg", c)
+	}
+
+	for _, q := range []string{"?w=10&h=10&fit=squash", "?w=10&h=10&gravity=up"} {
+		if _, code := get(q); code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d, want 400", q, code)
+		}
+	}
+}
+
+func TestSmartGravity(t *testing.T) {
+	h := newTestServer(t)
+	// flat grey 120x40 with a textured skin-toned patch near the right edge
+	src := image.NewNRGBA(image.Rect(0, 0, 120, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 120; x++ {
+			c := color.NRGBA{128, 128, 128, 255}
+			if x >= 92 && x < 112 && y >= 10 && y < 30 {
+				c = color.NRGBA{224, 160, 130, 255}
+				if (x/2+y/2)%2 == 0 {
+					c = color.NRGBA{180, 120, 90, 255}
+				}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	id := upload(t, h, encodeAs(t, "png", src), "x.png")
+
+	get := func(q string) []byte {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+".png"+q, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d", q, w.Code)
+		}
+		return w.Body.Bytes()
+	}
+	isGrey := func(c color.Color) bool {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		return n.R == n.G && n.G == n.B
+	}
+
+	out := get("?w=40&h=40&fit=cover&gravity=smart")
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isGrey(img.At(22, 20)) {
+		t.Fatalf("smart crop missed the subject: centre pixel %v", img.At(22, 20))
+	}
+	center, _ := png.Decode(bytes.NewReader(get("?w=40&h=40&fit=cover")))
+	if !isGrey(center.At(20, 20)) {
+		t.Fatalf("fixture broken: centre crop already contains the subject")
+	}
+	if again := get("?w=40&h=40&thumb=1&gravity=smart"); !bytes.Equal(again, out) {
+		t.Fatalf("smart crop is not deterministic")
+	}
+}
+
+func TestFocalPoint(t *testing.T) {
+	h := newTestServer(t)
+	// red, green and blue thirds
+	src := image.NewNRGBA(image.Rect(0, 0, 120, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 120; x++ {
+			c := color.NRGBA{255, 0, 0, 255}
+			if x >= 80 {
+				c = color.NRGBA{0, 0, 255, 255}
+			} else if x >= 40 {
+				c = color.NRGBA{0, 255, 0, 255}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	id := upload(t, h, encodeAs(t, "png", src), "x.png")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	centre := func(q string) (color.NRGBA, string) {
+		w := do(http.MethodGet, "/images/"+id+".png"+q, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d", q, w.Code)
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA), w.Header().Get("ETag")
+	}
+	const thumb = "?w=20&h=20&thumb=1"
+
+	if c, _ := centre(thumb); c.G != 255 {
+		t.Fatalf("default crop %v, want green", c)
+	}
+	_, before := centre(thumb)
+
+	for _, body := range []string{`{"x":1.5,"y":0.5}`, `{"x":0.5}`, `not json`} {
+		if w := do(http.MethodPut, "/images/"+id+"/focal", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("PUT %s: status=%d, want 400", body, w.Code)
+		}
+	}
+	if w := do(http.MethodPut, "/images/nope/focal", `{"x":0.5,"y":0.5}`); w.Code != http.StatusNotFound {
+		t.Fatalf("PUT unknown image: status=%d, want 404", w.Code)
+	}
+	if w := do(http.MethodPut, "/images/"+id+"/focal", `{"x":0.9,"y":0.5}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT focal: status=%d body=%s", w.Code, w.Body.String())
+	}
+
+	w := do(http.MethodGet, "/images/"+id+"/meta", "")
+	var meta api.ImageMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Focal == nil || meta.Focal.X != 0.9 || meta.Focal.Y != 0.5 {
+		t.Fatalf("meta focal = %+v", meta.Focal)
+	}
+
+	c, after := centre(thumb)
+	if c.B != 255 {
+		t.Fatalf("crop with stored focal point %v, want blue", c)
+	}
+	if after == before {
+		t.Fatalf("ETag unchanged after setting the focal point")
+	}
+	if c, _ := centre("?w=20&h=20&fit=cover&fp=0.1,0.5"); c.R != 255 {
+		t.Fatalf("crop with fp %v, want red", c)
+	}
+	if c, _ := centre(thumb + "&gravity=center"); c.G != 255 {
+		t.Fatalf("crop with explicit gravity %v, want green", c)
+	}
+	if w := do(http.MethodGet, "/images/"+id+".png"+thumb+"&fp=1,2", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("fp out of range: status=%d, want 400", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/images/"+id+"/focal", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE focal: status=%d", w.Code)
+	}
+	if c, _ := centre(thumb); c.G != 255 {
+		t.Fatalf("crop after clearing the focal point %v, want green", c)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	h := newTestServer(t)
+	// left half one colour, right half another, so blur has an edge to soften
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			c := color.NRGBA{200, 100, 50, 255}
+			if x >= 10 {
+				c = color.NRGBA{255, 0, 0, 255}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	id := upload(t, h, encodeAs(t, "png", src), "x.png")
+
+	get := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+".png"+q, nil))
+		return w
+	}
+	at := func(q string, x int) color.NRGBA {
+		w := get(q)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d body=%s", q, w.Code, w.Body.String())
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return color.NRGBAModel.Convert(img.At(x, 5)).(color.NRGBA)
+	}
+
+	if c := at("?invert=1", 2); c != (color.NRGBA{55, 155, 205, 255}) {
+		t.Fatalf("invert = %v", c)
+	}
+	if c := at("?brightness=-100", 2); c != (color.NRGBA{0, 0, 0, 255}) {
+		t.Fatalf("brightness=-100 = %v", c)
+	}
+	if c := at("?hue=120", 17); c.G <= c.R || c.G <= c.B {
+		t.Fatalf("hue=120 on red = %v, want green dominant", c)
+	}
+	if c := at("?saturation=-100", 17); c.R != c.G || c.G != c.B {
+		t.Fatalf("saturation=-100 = %v, want grey", c)
+	}
+	// sepia runs after grayscale, so the result is tinted rather than grey
+	if c := at("?gray=1&sepia=100", 2); !(c.R > c.G && c.G > c.B) {
+		t.Fatalf("gray+sepia = %v, want sepia tone", c)
+	}
+	if c := at("?gamma=1", 2); c != (color.NRGBA{200, 100, 50, 255}) {
+		t.Fatalf("gamma=1 changed the image: %v", c)
+	}
+	if c := at("?blur=2", 10); c.G == 0 || c.G == 100 {
+		t.Fatalf("blur left a hard edge: %v", c)
+	}
+	// blur runs after resizing, so its sigma is in output pixels: a 2px blur
+	// of a 10x downscale still spreads over several output pixels
+	wide := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(wide, image.Rect(100, 0, 200, 100), image.NewUniform(color.White), image.Point{}, draw.Src)
+	wideID := upload(t, h, encodeAs(t, "png", wide), "wide.png")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+wideID+".png?w=20&blur=2", nil))
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("decode: %v (status %d)", err, w.Code)
+	}
+	if c := color.NRGBAModel.Convert(img.At(8, 5)).(color.NRGBA); c.A == 0 || c.A == 255 {
+		t.Fatalf("pixel 2px from the edge = %v, want blurred", c)
+	}
+
+	for _, q := range []string{"?blur=-1", "?blur=100", "?sharpen=11", "?gamma=0.01", "?brightness=101", "?saturation=200", "?hue=abc", "?sepia=-5"} {
+		if w := get(q); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	h := newTestServer(t)
+	base := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(base, base.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	mark := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(mark, mark.Rect, image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	id := upload(t, h, encodeAs(t, "png", base), "base.png")
+	wm := upload(t, h, encodeAs(t, "png", mark), "wm.png")
+
+	get := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/images/"+id+".png"+q, nil))
+		return w
+	}
+	decode := func(q string) image.Image {
+		w := get(q)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d body=%s", q, w.Code, w.Body.String())
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	isRed := func(c color.Color) bool { return color.NRGBAModel.Convert(c) == color.NRGBA{255, 0, 0, 255} }
+
+	// bottom-right by default, a fifth of the output size
+	img := decode("?wm=" + wm + "&wm_scale=0.2")
+	if !isRed(img.At(95, 95)) || isRed(img.At(75, 75)) || isRed(img.At(50, 50)) {
+		t.Fatalf("default placement: (95,95)=%v (75,75)=%v", img.At(95, 95), img.At(75, 75))
+	}
+	// composited after resizing, so it keeps its size relative to the output
+	img = decode("?w=50&wm=" + wm + "&wm_scale=0.2")
+	if !isRed(img.At(45, 45)) || isRed(img.At(35, 35)) {
+		t.Fatalf("after resize: (45,45)=%v (35,35)=%v", img.At(45, 45), img.At(35, 35))
+	}
+	img = decode("?wm=" + wm + "&wm_scale=0.2&wm_pos=nw&wm_margin=10")
+	if !isRed(img.At(15, 15)) || isRed(img.At(5, 5)) || isRed(img.At(95, 95)) {
+		t.Fatalf("nw with margin: (5,5)=%v (15,15)=%v", img.At(5, 5), img.At(15, 15))
+	}
+	img = decode("?wm=" + wm + "&wm_scale=0.2&wm_opacity=0.5")
+	if c := color.NRGBAModel.Convert(img.At(95, 95)).(color.NRGBA); c.R != 255 || c.G < 120 || c.G > 135 {
+		t.Fatalf("half opacity: %v", c)
+	}
+	// 10px tiles every 20px starting at the margin
+	img = decode("?wm=" + wm + "&wm_scale=0.1&wm_margin=10&wm_tile=1")
+	for _, p := range []image.Point{{15, 15}, {55, 75}, {95, 35}} {
+		if !isRed(img.At(p.X, p.Y)) {
+			t.Fatalf("tile missing at %v: %v", p, img.At(p.X, p.Y))
+		}
+	}
+	if isRed(img.At(25, 25)) || isRed(img.At(5, 5)) {
+		t.Fatalf("tiles overlap their margins")
+	}
+
+	for _, q := range []string{"?wm=default", "?wm=nope", "?wm=" + wm + "&wm_scale=0", "?wm=" + wm + "&wm_opacity=2", "?wm=" + wm + "&wm_margin=-1", "?wm=" + wm + "&wm_pos=smart"} {
+		if w := get(q); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestStatsEndpointServesOnlyCounters(t *testing.T) {
+	h := newTestServer(t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status=%d", w.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vars["imgapi"]; !ok || len(vars) != 1 {
+		t.Fatalf("vars has keys %v, want only imgapi", reflect.ValueOf(vars).MapKeys())
+	}
+}
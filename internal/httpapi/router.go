@@ -28,6 +28,7 @@ func (s *Server) Handler() http.Handler { return s.mux }
 
 func (s *Server) routes() {
 	s.mux.HandleFunc("/healthz", s.handleHealth)
-	s.mux.HandleFunc("/images", s.handleImages)    // POST
-	s.mux.HandleFunc("/images/", s.handleGetImage) // GET
+	s.mux.HandleFunc("/debug/vars", s.handleStats) // GET, metrics
+	s.mux.HandleFunc("/images", s.handleImages)    // POST, GET
+	s.mux.HandleFunc("/images/", s.handleImage)    // GET, HEAD, DELETE
 }
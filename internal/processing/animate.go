@@ -0,0 +1,162 @@
+package processing
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// maxGIFPixels bounds the logical screen area times the number of frames
+// coalesced for one request. Each coalesced frame costs a full screen of
+// NRGBA pixels however small the frame itself is, so without a bound a tiny
+// file with a huge screen could exhaust memory.
+const maxGIFPixels = 1 << 25
+
+// checkGIFSize reports whether coalescing n frames of the GIF in b stays
+// within maxGIFPixels. It reads only the header.
+func checkGIFSize(b []byte, n int) error {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if px := int64(cfg.Width) * int64(cfg.Height) * int64(n); px > maxGIFPixels {
+		return fmt.Errorf("gif too large: %dx%d screen with %d frames exceeds %d pixels", cfg.Width, cfg.Height, n, maxGIFPixels)
+	}
+	return nil
+}
+
+// gifFrameCount counts the frames of the GIF in b by walking its blocks,
+// without decoding any pixel data. Truncated or malformed input yields the
+// frames seen so far; decoding reports the error.
+func gifFrameCount(b []byte) int {
+	if len(b) < 13 {
+		return 0
+	}
+	p := 13
+	if b[10]&0x80 != 0 {
+		p += 3 << (b[10]&7 + 1) // global colour table
+	}
+	// skipSubBlocks advances p past a sequence of data sub-blocks.
+	skipSubBlocks := func() {
+		for p < len(b) {
+			n := int(b[p])
+			p += 1 + n
+			if n == 0 {
+				return
+			}
+		}
+	}
+	frames := 0
+	for p < len(b) {
+		switch b[p] {
+		case 0x21: // extension: introducer, label, sub-blocks
+			p += 2
+			skipSubBlocks()
+		case 0x2C: // image descriptor, local colour table, LZW code size, sub-blocks
+			if p+10 > len(b) {
+				return frames
+			}
+			flags := b[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (flags&7 + 1)
+			}
+			p++
+			skipSubBlocks()
+			frames++
+		default: // trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// coalesce renders the first n frames of g onto the full logical screen,
+// applying each frame's disposal before the next is drawn, so frames can be
+// processed as independent images. fn is called with the screen after each
+// frame is drawn; it must copy the screen to keep it, except for the last
+// call, after which the screen is no longer changed.
+func coalesce(g *gif.GIF, n int, fn func(i int, screen *image.NRGBA)) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, f := range g.Image[:n] {
+		bounds = bounds.Union(f.Bounds())
+	}
+	canvas := image.NewNRGBA(bounds)
+	for i, f := range g.Image[:n] {
+		var prev *image.NRGBA
+		if i < n-1 && disposal(g, i) == gif.DisposalPrevious {
+			prev = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, f.Bounds(), f, f.Bounds().Min, draw.Over)
+		fn(i, canvas)
+		if i == n-1 {
+			return
+		}
+		switch disposal(g, i) {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, f.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+}
+
+// encodeAnimated transforms every frame of g and re-encodes the animation.
+// Output frames cover the whole canvas, so the source delays, disposal methods
+// and loop count still describe the same animation.
+func encodeAnimated(g *gif.GIF, opts Options) ([]byte, string, error) {
+	o := gifOptions(opts)
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(g.Image)),
+		Delay:     append([]int(nil), g.Delay...),
+		Disposal:  append([]byte(nil), g.Disposal...),
+		LoopCount: g.LoopCount,
+	}
+	frames := make([]image.Image, len(g.Image))
+	var err error
+	coalesce(g, len(g.Image), func(i int, screen *image.NRGBA) {
+		if err == nil {
+			frames[i], err = prepare(cloneNRGBA(screen), opts)
+		}
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.CoverCrop() && opts.Focal == nil && opts.gravity() == GravitySmart && len(frames) > 0 {
+		// one window for the whole animation, so the crop does not jump
+		// between frames as the subject moves
+		r := smartRect(frames, coverSize(frames[0].Bounds().Size(), opts.Width, opts.Height))
+		opts.coverWindow = &r
+	}
+	for _, f := range frames {
+		img, err := finish(f, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		b := img.Bounds()
+		pm := image.NewPaletted(b, o.Quantizer.Quantize(make(color.Palette, 0, o.NumColors), img))
+		o.Drawer.Draw(pm, b, img, b.Min)
+		out.Image = append(out.Image, pm)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ContentType(FormatGIF), nil
+}
+
+func disposal(g *gif.GIF, i int) byte {
+	if i < len(g.Disposal) {
+		return g.Disposal[i]
+	}
+	return gif.DisposalNone
+}
+
+func cloneNRGBA(m *image.NRGBA) *image.NRGBA {
+	c := *m
+	c.Pix = append([]uint8(nil), m.Pix...)
+	return &c
+}
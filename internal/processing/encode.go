@@ -0,0 +1,156 @@
+package processing
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"sort"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// TIFF compression schemes accepted in Options.Compression.
+const (
+	CompressionDeflate = "deflate"
+	CompressionNone    = "none"
+)
+
+// encode writes img in the target format using the format-specific options.
+func encode(img image.Image, target SupportedFormat, opts Options) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var err error
+	switch target {
+	case FormatJPEG:
+		q := opts.Quality
+		if q <= 0 || q > 100 {
+			q = 85
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: q})
+	case FormatPNG:
+		err = png.Encode(&buf, img)
+	case FormatGIF:
+		err = gif.Encode(&buf, img, gifOptions(opts))
+	case FormatBMP:
+		err = bmp.Encode(&buf, img)
+	case FormatTIFF:
+		err = tiff.Encode(&buf, img, tiffOptions(opts))
+	default:
+		return nil, "", errUnsupported
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ContentType(target), nil
+}
+
+func gifOptions(opts Options) *gif.Options {
+	o := &gif.Options{NumColors: 256, Quantizer: medianCut{}, Drawer: draw.FloydSteinberg}
+	if opts.Colors > 0 && opts.Colors < 256 {
+		o.NumColors = opts.Colors
+	}
+	if opts.NoDither {
+		o.Drawer = draw.Src
+	}
+	return o
+}
+
+func tiffOptions(opts Options) *tiff.Options {
+	if opts.Compression == CompressionNone {
+		return &tiff.Options{Compression: tiff.Uncompressed}
+	}
+	return &tiff.Options{Compression: tiff.Deflate}
+}
+
+// maxQuantizeSamples bounds the pixels considered when building a palette.
+const maxQuantizeSamples = 1 << 16
+
+// medianCut builds a GIF palette by repeatedly splitting the colour box with
+// the widest channel range at its median. It replaces the default Plan 9
+// palette, which looks poor once truncated to a small number of colours.
+// Images with transparent pixels get a fully transparent palette entry.
+type medianCut struct{}
+
+func (medianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	if n <= 0 {
+		return p
+	}
+	b := m.Bounds()
+	step := 1
+	for (b.Dx()/step)*(b.Dy()/step) > maxQuantizeSamples {
+		step++
+	}
+	var px [][3]uint8
+	transparent := false
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if c.A < 0x80 {
+				transparent = true
+				continue
+			}
+			px = append(px, [3]uint8{c.R, c.G, c.B})
+		}
+	}
+	if transparent {
+		p = append(p, color.NRGBA{})
+		n--
+	}
+	if len(px) == 0 || n <= 0 {
+		return p
+	}
+
+	boxes := [][][3]uint8{px}
+	for len(boxes) < n {
+		// split the box with the widest single-channel range
+		best, bestCh, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			ch, r := widestChannel(box)
+			if r > bestRange {
+				best, bestCh, bestRange = i, ch, r
+			}
+		}
+		if best < 0 {
+			break // every box holds a single colour
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return box[i][bestCh] < box[j][bestCh] })
+		mid := len(box) / 2
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+	for _, box := range boxes {
+		var sum [3]int
+		for _, c := range box {
+			sum[0] += int(c[0])
+			sum[1] += int(c[1])
+			sum[2] += int(c[2])
+		}
+		k := len(box)
+		p = append(p, color.NRGBA{uint8(sum[0] / k), uint8(sum[1] / k), uint8(sum[2] / k), 0xff})
+	}
+	return p
+}
+
+// widestChannel returns the RGB channel with the largest value range in box.
+func widestChannel(box [][3]uint8) (int, int) {
+	if len(box) < 2 {
+		return 0, 0
+	}
+	ch, width := 0, 0
+	for c := 0; c < 3; c++ {
+		lo, hi := box[0][c], box[0][c]
+		for _, v := range box {
+			lo, hi = min(lo, v[c]), max(hi, v[c])
+		}
+		if int(hi-lo) > width {
+			ch, width = c, int(hi-lo)
+		}
+	}
+	return ch, width
+}
@@ -0,0 +1,294 @@
+package processing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// exifHeader prefixes EXIF data in a JPEG APP1 segment.
+const exifHeader = "Exif\x00\x00"
+
+// EXIF tags read by this package.
+const (
+	tagImageDescription   = 0x010E
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagSoftware           = 0x0131
+	tagDateTime           = 0x0132
+	tagArtist             = 0x013B
+	tagCopyright          = 0x8298
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagExifIFD            = 0x8769
+	tagISO                = 0x8827
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagLensModel          = 0xA434
+
+	tagGPSLatitudeRef  = 0x01
+	tagGPSLatitude     = 0x02
+	tagGPSLongitudeRef = 0x03
+	tagGPSLongitude    = 0x04
+	tagGPSAltitudeRef  = 0x05
+	tagGPSAltitude     = 0x06
+)
+
+// maxIFDEntries bounds the entries read from one IFD of untrusted input.
+const maxIFDEntries = 1000
+
+// tiffReader reads IFDs from a TIFF-format block (EXIF data or a TIFF file).
+type tiffReader struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+func newTIFFReader(b []byte) (*tiffReader, bool) {
+	if len(b) < 8 {
+		return nil, false
+	}
+	t := &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, false
+	}
+	if t.bo.Uint16(b[2:]) != 42 {
+		return nil, false
+	}
+	return t, true
+}
+
+// ifdEntry is a raw IFD field: its type, count and value bytes.
+type ifdEntry struct {
+	typ   uint16
+	count int
+	val   []byte
+}
+
+// typeSizes holds the byte size of the TIFF field types this package reads.
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ifd reads the IFD at off. Fields with unknown types or out-of-bounds values
+// are skipped.
+func (t *tiffReader) ifd(off uint32) map[uint16]ifdEntry {
+	out := map[uint16]ifdEntry{}
+	if off < 8 || int64(off)+2 > int64(len(t.b)) {
+		return out
+	}
+	n := min(int(t.bo.Uint16(t.b[off:])), maxIFDEntries)
+	for i := 0; i < n; i++ {
+		e := int(off) + 2 + 12*i
+		if e+12 > len(t.b) {
+			break
+		}
+		typ := t.bo.Uint16(t.b[e+2:])
+		size, ok := typeSizes[typ]
+		count := t.bo.Uint32(t.b[e+4:])
+		if !ok || count > uint32(len(t.b)) {
+			continue
+		}
+		total := size * int(count)
+		start := e + 8
+		if total > 4 {
+			start = int(t.bo.Uint32(t.b[e+8:]))
+		}
+		if start < 0 || start+total > len(t.b) {
+			continue
+		}
+		out[t.bo.Uint16(t.b[e:])] = ifdEntry{typ: typ, count: int(count), val: t.b[start : start+total]}
+	}
+	return out
+}
+
+func (t *tiffReader) str(ifd map[uint16]ifdEntry, tag uint16) string {
+	e, ok := ifd[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(e.val), "\x00")
+	return strings.TrimSpace(s)
+}
+
+// uint returns the first value of an unsigned integer field.
+func (t *tiffReader) uint(ifd map[uint16]ifdEntry, tag uint16) (uint32, bool) {
+	e, ok := ifd[tag]
+	if !ok || e.count == 0 {
+		return 0, false
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(e.val[0]), true
+	case 3:
+		return uint32(t.bo.Uint16(e.val)), true
+	case 4:
+		return t.bo.Uint32(e.val), true
+	}
+	return 0, false
+}
+
+// rationals returns the values of a RATIONAL or SRATIONAL field as
+// numerator/denominator pairs.
+func (t *tiffReader) rationals(ifd map[uint16]ifdEntry, tag uint16) [][2]int64 {
+	e, ok := ifd[tag]
+	if !ok || (e.typ != 5 && e.typ != 10) {
+		return nil
+	}
+	out := make([][2]int64, e.count)
+	for i := range out {
+		num, den := t.bo.Uint32(e.val[8*i:]), t.bo.Uint32(e.val[8*i+4:])
+		if e.typ == 10 {
+			out[i] = [2]int64{int64(int32(num)), int64(int32(den))}
+		} else {
+			out[i] = [2]int64{int64(num), int64(den)}
+		}
+	}
+	return out
+}
+
+func (t *tiffReader) float(ifd map[uint16]ifdEntry, tag uint16) float64 {
+	r := t.rationals(ifd, tag)
+	if len(r) == 0 || r[0][1] == 0 {
+		return 0
+	}
+	return float64(r[0][0]) / float64(r[0][1])
+}
+
+// parseEXIF fills m from a TIFF-format EXIF block, without overwriting
+// fields that are already set.
+func parseEXIF(b []byte, m *EmbeddedMetadata) {
+	t, ok := newTIFFReader(b)
+	if !ok {
+		return
+	}
+	ifd0 := t.ifd(t.bo.Uint32(b[4:]))
+	var exif, gps map[uint16]ifdEntry
+	if off, ok := t.uint(ifd0, tagExifIFD); ok {
+		exif = t.ifd(off)
+	}
+	if off, ok := t.uint(ifd0, tagGPSIFD); ok {
+		gps = t.ifd(off)
+	}
+
+	setString(&m.Make, t.str(ifd0, tagMake))
+	setString(&m.Model, t.str(ifd0, tagModel))
+	setString(&m.Software, t.str(ifd0, tagSoftware))
+	setString(&m.Artist, t.str(ifd0, tagArtist))
+	setString(&m.Copyright, t.str(ifd0, tagCopyright))
+	setString(&m.Description, t.str(ifd0, tagImageDescription))
+	setString(&m.LensModel, t.str(exif, tagLensModel))
+	if o, ok := t.uint(ifd0, tagOrientation); ok && o >= 1 && o <= 8 && m.Orientation == 0 {
+		m.Orientation = int(o)
+	}
+
+	taken := t.str(exif, tagDateTimeOriginal)
+	if taken == "" {
+		taken = t.str(ifd0, tagDateTime)
+	}
+	setString(&m.CaptureTime, exifTime(taken, t.str(exif, tagOffsetTimeOriginal)))
+
+	if r := t.rationals(exif, tagExposureTime); len(r) > 0 && r[0][0] > 0 && r[0][1] > 0 && m.ExposureTime == "" {
+		m.ExposureTime = exposureString(r[0][0], r[0][1])
+	}
+	if m.FNumber == 0 {
+		m.FNumber = round(t.float(exif, tagFNumber), 1)
+	}
+	if m.FocalLength == 0 {
+		m.FocalLength = round(t.float(exif, tagFocalLength), 1)
+	}
+	if iso, ok := t.uint(exif, tagISO); ok && m.ISO == 0 {
+		m.ISO = int(iso)
+	}
+
+	if m.GPS == nil {
+		lat, latOK := gpsCoordinate(t.rationals(gps, tagGPSLatitude), t.str(gps, tagGPSLatitudeRef), "S")
+		lon, lonOK := gpsCoordinate(t.rationals(gps, tagGPSLongitude), t.str(gps, tagGPSLongitudeRef), "W")
+		if latOK && lonOK {
+			m.GPS = &GPS{Latitude: lat, Longitude: lon}
+			if r := t.rationals(gps, tagGPSAltitude); len(r) > 0 && r[0][1] != 0 {
+				alt := round(float64(r[0][0])/float64(r[0][1]), 2)
+				if ref, _ := t.uint(gps, tagGPSAltitudeRef); ref == 1 {
+					alt = -alt // below sea level
+				}
+				m.GPS.Altitude = &alt
+			}
+		}
+	}
+}
+
+// exifOrientation returns the Orientation tag (1-8) from IFD0 of a TIFF-format
+// EXIF block, or 0 if it is missing or malformed.
+func exifOrientation(b []byte) int {
+	t, ok := newTIFFReader(b)
+	if !ok {
+		return 0
+	}
+	o, ok := t.uint(t.ifd(t.bo.Uint32(b[4:])), tagOrientation)
+	if !ok || o < 1 || o > 8 {
+		return 0
+	}
+	return int(o)
+}
+
+// orientationEXIF builds a minimal big-endian TIFF-format EXIF block holding
+// only the Orientation tag.
+func orientationEXIF(o int) []byte {
+	return []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, IFD0 at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0, // Orientation, SHORT, count 1
+		0, 0, 0, 0, // no next IFD
+	}
+}
+
+// exifTime converts an EXIF "YYYY:MM:DD HH:MM:SS" timestamp and optional
+// "+HH:MM" offset to ISO 8601.
+func exifTime(ts, offset string) string {
+	if len(ts) < 19 || ts[4] != ':' || ts[7] != ':' || strings.HasPrefix(ts, "0000") {
+		return ""
+	}
+	out := ts[:4] + "-" + ts[5:7] + "-" + ts[8:10] + "T" + ts[11:19]
+	if len(offset) == 6 && (offset[0] == '+' || offset[0] == '-') {
+		out += offset
+	}
+	return out
+}
+
+// exposureString formats an exposure time as photographers write it: "1/250"
+// below one second, decimal seconds otherwise.
+func exposureString(num, den int64) string {
+	if num < den {
+		return fmt.Sprintf("1/%d", int64(math.Round(float64(den)/float64(num))))
+	}
+	return fmt.Sprintf("%g", round(float64(num)/float64(den), 1))
+}
+
+// gpsCoordinate converts degrees/minutes/seconds to signed decimal degrees.
+func gpsCoordinate(dms [][2]int64, ref, negRef string) (float64, bool) {
+	if len(dms) != 3 {
+		return 0, false
+	}
+	var v float64
+	for i, div := range []float64{1, 60, 3600} {
+		if dms[i][1] == 0 {
+			return 0, false
+		}
+		v += float64(dms[i][0]) / float64(dms[i][1]) / div
+	}
+	if strings.EqualFold(ref, negRef) {
+		v = -v
+	}
+	return round(v, 6), true
+}
+
+func round(v float64, places int) float64 {
+	p := math.Pow10(places)
+	return math.Round(v*p) / p
+}
@@ -0,0 +1,169 @@
+package processing
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Accepted ranges of the filter options. Blur and sharpen are bounded because
+// their cost grows with sigma.
+const (
+	maxBlur    = 50
+	maxSharpen = 10
+	minGamma   = 0.1
+	maxGamma   = 10
+)
+
+// hasFilters reports whether opts request any colour or detail filter.
+func (o Options) hasFilters() bool {
+	return o.Brightness != 0 || o.Contrast != 0 || (o.Gamma != 0 && o.Gamma != 1) || o.Saturation != 0 ||
+		math.Mod(o.Hue, 360) != 0 || o.Grayscale || o.Sepia != 0 || o.Invert || o.Blur != 0 || o.Sharpen != 0
+}
+
+// validateFilters reports filter options outside their accepted range.
+func (o Options) validateFilters() error {
+	for _, f := range []struct {
+		name     string
+		v        float64
+		min, max float64
+	}{
+		{"brightness", o.Brightness, -100, 100},
+		{"contrast", o.Contrast, -100, 100},
+		{"saturation", o.Saturation, -100, 100},
+		{"hue", o.Hue, -360, 360},
+		{"sepia", o.Sepia, 0, 100},
+		{"blur", o.Blur, 0, maxBlur},
+		{"sharpen", o.Sharpen, 0, maxSharpen},
+	} {
+		if !(f.v >= f.min && f.v <= f.max) { // also rejects NaN
+			return fmt.Errorf("%s must be between %g and %g", f.name, f.min, f.max)
+		}
+	}
+	if o.Gamma != 0 && !(o.Gamma >= minGamma && o.Gamma <= maxGamma) {
+		return fmt.Errorf("gamma must be between %g and %g", float64(minGamma), float64(maxGamma))
+	}
+	return nil
+}
+
+// writeFilterKey appends the colour filters in opts to a cache key, in the
+// order applyFilters runs them.
+func (o Options) writeFilterKey(b *strings.Builder) {
+	num := func(name string, v float64) {
+		b.WriteString(";" + name + "=" + strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	if o.Brightness != 0 {
+		num("bri", o.Brightness)
+	}
+	if o.Contrast != 0 {
+		num("con", o.Contrast)
+	}
+	if o.Gamma != 0 && o.Gamma != 1 {
+		num("gam", o.Gamma)
+	}
+	if o.Saturation != 0 {
+		num("sat", o.Saturation)
+	}
+	if hue := math.Mod(o.Hue, 360); hue != 0 {
+		num("hue", hue)
+	}
+	if o.Grayscale {
+		b.WriteString(";gray")
+	}
+	if o.Sepia != 0 {
+		num("sepia", o.Sepia)
+	}
+	if o.Invert {
+		b.WriteString(";inv")
+	}
+}
+
+// writeDetailKey appends blur and sharpen to a cache key. They follow the
+// resize parts because they run after resizing.
+func (o Options) writeDetailKey(b *strings.Builder) {
+	if o.Blur != 0 {
+		b.WriteString(";blur=" + strconv.FormatFloat(o.Blur, 'f', -1, 64))
+	}
+	if o.Sharpen != 0 {
+		b.WriteString(";sharp=" + strconv.FormatFloat(o.Sharpen, 'f', -1, 64))
+	}
+}
+
+// applyFilters runs the colour filters in opts in a fixed order: brightness,
+// contrast, gamma, saturation, hue, grayscale, sepia, invert.
+func applyFilters(img image.Image, opts Options) image.Image {
+	if opts.Brightness != 0 {
+		img = imaging.AdjustBrightness(img, opts.Brightness)
+	}
+	if opts.Contrast != 0 {
+		img = imaging.AdjustContrast(img, opts.Contrast)
+	}
+	if opts.Gamma != 0 && opts.Gamma != 1 {
+		img = imaging.AdjustGamma(img, opts.Gamma)
+	}
+	if opts.Saturation != 0 {
+		img = imaging.AdjustSaturation(img, opts.Saturation)
+	}
+	if hue := math.Mod(opts.Hue, 360); hue != 0 {
+		img = imaging.AdjustFunc(img, hueRotate(hue).apply)
+	}
+	if opts.Grayscale {
+		img = imaging.Grayscale(img)
+	}
+	if opts.Sepia != 0 {
+		img = imaging.AdjustFunc(img, sepia(opts.Sepia/100).apply)
+	}
+	if opts.Invert {
+		img = imaging.Invert(img)
+	}
+	return img
+}
+
+// applyDetail blurs, then sharpens, the resized image, so sigmas are measured
+// in output pixels and look the same at every source size.
+func applyDetail(img image.Image, opts Options) image.Image {
+	if opts.Blur != 0 {
+		img = imaging.Blur(img, opts.Blur)
+	}
+	if opts.Sharpen != 0 {
+		img = imaging.Sharpen(img, opts.Sharpen)
+	}
+	return img
+}
+
+// colorMatrix is a 3x3 linear transform of RGB, leaving alpha alone.
+type colorMatrix [3][3]float64
+
+func (m *colorMatrix) apply(c color.NRGBA) color.NRGBA {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	ch := func(row [3]float64) uint8 {
+		return uint8(math.Round(math.Min(255, math.Max(0, row[0]*r+row[1]*g+row[2]*b))))
+	}
+	return color.NRGBA{ch(m[0]), ch(m[1]), ch(m[2]), c.A}
+}
+
+// hueRotate returns the luminance-preserving hue rotation by deg degrees of
+// the CSS hue-rotate() filter.
+func hueRotate(deg float64) *colorMatrix {
+	sin, cos := math.Sincos(deg * math.Pi / 180)
+	return &colorMatrix{
+		{0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928},
+		{0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283},
+		{0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072},
+	}
+}
+
+// sepia returns the CSS sepia() filter at amount 0-1.
+func sepia(amount float64) *colorMatrix {
+	k := 1 - amount
+	return &colorMatrix{
+		{0.393 + 0.607*k, 0.769 - 0.769*k, 0.189 - 0.189*k},
+		{0.349 - 0.349*k, 0.686 + 0.314*k, 0.168 - 0.168*k},
+		{0.272 - 0.272*k, 0.534 - 0.534*k, 0.131 + 0.869*k},
+	}
+}
@@ -0,0 +1,193 @@
+package processing
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Fit modes for resizing to both a width and a height, following CSS
+// object-fit and sharp.
+const (
+	FitFill    = "fill"    // stretch to exactly w x h, ignoring aspect ratio
+	FitCover   = "cover"   // cover w x h, cropping the overflow at the gravity
+	FitContain = "contain" // fit inside w x h and pad to exactly w x h with bg
+	FitInside  = "inside"  // fit inside w x h; output may be smaller on one side
+	FitOutside = "outside" // cover w x h without cropping; output may be larger on one side
+	FitPad     = "pad"     // like contain, but never enlarge the image
+)
+
+// Gravity anchors name the compass points and centre.
+const GravityCenter = "center"
+
+var gravities = map[string]string{
+	"n": "n", "north": "n", "top": "n",
+	"ne": "ne", "northeast": "ne",
+	"e": "e", "east": "e", "right": "e",
+	"se": "se", "southeast": "se",
+	"s": "s", "south": "s", "bottom": "s",
+	"sw": "sw", "southwest": "sw",
+	"w": "w", "west": "w", "left": "w",
+	"nw": "nw", "northwest": "nw",
+	"c": GravityCenter, "center": GravityCenter, "centre": GravityCenter,
+	GravitySmart: GravitySmart,
+}
+
+// ParseGravity returns the canonical name of a gravity anchor: n, ne, e, se,
+// s, sw, w, nw, center or smart. Long names such as "northeast" are accepted.
+func ParseGravity(s string) (string, error) {
+	g, ok := gravities[strings.ToLower(s)]
+	if !ok {
+		return "", fmt.Errorf("unknown gravity %q", s)
+	}
+	return g, nil
+}
+
+// FocalPoint is a position normalized to the image size: (0,0) is the
+// top-left corner and (1,1) the bottom-right.
+type FocalPoint struct {
+	X, Y float64
+}
+
+// ParseFocalPoint parses "x,y" with both values between 0 and 1.
+func ParseFocalPoint(s string) (FocalPoint, error) {
+	xs, ys, ok := strings.Cut(s, ",")
+	x, errX := strconv.ParseFloat(strings.TrimSpace(xs), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(ys), 64)
+	fp := FocalPoint{X: x, Y: y}
+	if !ok || errX != nil || errY != nil || !fp.Valid() {
+		return FocalPoint{}, fmt.Errorf("focal point must be x,y between 0 and 1")
+	}
+	return fp, nil
+}
+
+// Valid reports whether both coordinates lie within [0, 1].
+func (p FocalPoint) Valid() bool {
+	return p.X >= 0 && p.X <= 1 && p.Y >= 0 && p.Y <= 1
+}
+
+// CoverCrop reports whether opts crop to an aspect ratio (fit=cover or
+// thumbnail with both dimensions), the case a focal point applies to.
+func (o Options) CoverCrop() bool {
+	return o.Width > 0 && o.Height > 0 && o.fit() == FitCover
+}
+
+// fit returns the effective fit mode for resizing to both dimensions.
+func (o Options) fit() string {
+	switch {
+	case o.Fit != "":
+		return o.Fit
+	case o.Thumbnail:
+		return FitCover
+	default:
+		return FitFill
+	}
+}
+
+// gravity returns the canonical gravity, defaulting to center.
+func (o Options) gravity() string {
+	if o.Gravity == "" {
+		return GravityCenter
+	}
+	return o.Gravity
+}
+
+// anchorOffset returns where a box of size inner sits inside outer for gravity
+// g. Gravities other than the compass points, such as smart, centre the box.
+func anchorOffset(outer, inner image.Point, g string) image.Point {
+	free := outer.Sub(inner)
+	p := image.Pt(free.X/2, free.Y/2)
+	switch g {
+	case "nw", "w", "sw":
+		p.X = 0
+	case "ne", "e", "se":
+		p.X = free.X
+	}
+	switch g {
+	case "nw", "n", "ne":
+		p.Y = 0
+	case "sw", "s", "se":
+		p.Y = free.Y
+	}
+	return p
+}
+
+// resizeTo scales img to w x h (either may be 0 to keep the aspect ratio)
+// using the fit mode and gravity in opts.
+func resizeTo(img image.Image, w, h int, opts Options) image.Image {
+	if w == 0 || h == 0 {
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	}
+	b := img.Bounds()
+	sx, sy := float64(w)/float64(b.Dx()), float64(h)/float64(b.Dy())
+	scaled := func(scale float64) image.Image {
+		sw := max(1, int(math.Round(float64(b.Dx())*scale)))
+		sh := max(1, int(math.Round(float64(b.Dy())*scale)))
+		return imaging.Resize(img, sw, sh, imaging.Lanczos)
+	}
+	switch opts.fit() {
+	case FitCover:
+		return imaging.Resize(imaging.Crop(img, coverRect(img, w, h, opts)), w, h, imaging.Lanczos)
+	case FitInside:
+		return scaled(min(sx, sy))
+	case FitOutside:
+		return scaled(max(sx, sy))
+	case FitContain:
+		return pad(scaled(min(sx, sy)), w, h, opts.gravity(), opts.Background)
+	case FitPad:
+		if s := min(sx, sy); s < 1 {
+			img = scaled(s)
+		}
+		return pad(img, w, h, opts.gravity(), opts.Background)
+	default:
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	}
+}
+
+// coverRect returns the largest region of img with the aspect ratio of w x h,
+// centred on opts' focal point if set and placed by its gravity otherwise.
+func coverRect(img image.Image, w, h int, opts Options) image.Rectangle {
+	if opts.coverWindow != nil {
+		return *opts.coverWindow
+	}
+	b := img.Bounds()
+	size := coverSize(b.Size(), w, h)
+	cw, ch := size.X, size.Y
+	var off image.Point
+	switch {
+	case opts.Focal != nil:
+		// centre on the focal point, shifted as needed to stay inside
+		free := b.Size().Sub(size)
+		off.X = min(max(int(math.Round(opts.Focal.X*float64(b.Dx())))-cw/2, 0), free.X)
+		off.Y = min(max(int(math.Round(opts.Focal.Y*float64(b.Dy())))-ch/2, 0), free.Y)
+	case opts.gravity() == GravitySmart:
+		return smartRect([]image.Image{img}, size)
+	default:
+		off = anchorOffset(b.Size(), size, opts.gravity())
+	}
+	return image.Rectangle{Min: b.Min.Add(off), Max: b.Min.Add(off).Add(size)}
+}
+
+// coverSize returns the size of the largest region of an image of size src
+// with the aspect ratio of w x h.
+func coverSize(src image.Point, w, h int) image.Point {
+	cw, ch := src.X, src.Y
+	if cw*h > ch*w {
+		cw = max(1, int(math.Round(float64(ch)*float64(w)/float64(h))))
+	} else {
+		ch = max(1, int(math.Round(float64(cw)*float64(h)/float64(w))))
+	}
+	return image.Pt(cw, ch)
+}
+
+// pad centres img, per gravity, on a w x h canvas filled with bg.
+func pad(img image.Image, w, h int, g string, bg color.Color) image.Image {
+	canvas := imaging.New(w, h, bg)
+	off := anchorOffset(image.Pt(w, h), img.Bounds().Size(), g)
+	return imaging.Overlay(canvas, img, off, 1)
+}
@@ -0,0 +1,126 @@
+package processing
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Length is a distance in pixels, or a percentage of the image dimension it
+// is measured along.
+type Length struct {
+	Value   float64
+	Percent bool
+}
+
+// px resolves l against a dimension of total pixels.
+func (l Length) px(total int) int {
+	if l.Percent {
+		return int(math.Round(l.Value * float64(total) / 100))
+	}
+	return int(math.Round(l.Value))
+}
+
+func (l Length) String() string {
+	s := strconv.FormatFloat(l.Value, 'f', -1, 64)
+	if l.Percent {
+		s += "%"
+	}
+	return s
+}
+
+// Crop selects the region with top-left corner (X, Y) and size W x H.
+type Crop struct {
+	X, Y, W, H Length
+}
+
+// IsZero reports whether no crop is requested.
+func (c Crop) IsZero() bool { return c == Crop{} }
+
+func (c Crop) String() string {
+	return c.X.String() + "," + c.Y.String() + "," + c.W.String() + "," + c.H.String()
+}
+
+// rect resolves c against an image of the given bounds, clipped to them.
+func (c Crop) rect(b image.Rectangle) image.Rectangle {
+	x, y := b.Min.X+c.X.px(b.Dx()), b.Min.Y+c.Y.px(b.Dy())
+	return image.Rect(x, y, x+c.W.px(b.Dx()), y+c.H.px(b.Dy())).Intersect(b)
+}
+
+// ParseCrop parses "x,y,w,h" where each value is a pixel count or, with a
+// trailing "%", a percentage of the image width (x, w) or height (y, h).
+func ParseCrop(s string) (Crop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Crop{}, errors.New("crop must be x,y,w,h")
+	}
+	var v [4]Length
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if v[i].Percent = strings.HasSuffix(p, "%"); v[i].Percent {
+			p = strings.TrimSuffix(p, "%")
+		}
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) || (v[i].Percent && f > 100) {
+			return Crop{}, fmt.Errorf("invalid crop value %q", parts[i])
+		}
+		v[i].Value = f
+	}
+	c := Crop{X: v[0], Y: v[1], W: v[2], H: v[3]}
+	if c.W.Value == 0 || c.H.Value == 0 {
+		return Crop{}, errors.New("crop width and height must be positive")
+	}
+	return c, nil
+}
+
+// ParseColor parses a hex colour: "rgb", "rrggbb" or "rrggbbaa", with an
+// optional leading "#".
+func ParseColor(s string) (color.NRGBA, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	n, err := strconv.ParseUint(h, 16, 32)
+	if len(h) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid colour %q", s)
+	}
+	return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+}
+
+func colorString(c color.NRGBA) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// normalizeAngle maps degrees to [0, 360).
+func normalizeAngle(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
+
+// rotate turns img clockwise by deg degrees. Right angles are exact; other
+// angles enlarge the canvas to fit and fill the corners with bg.
+func rotate(img image.Image, deg float64, bg color.Color) image.Image {
+	switch normalizeAngle(deg) {
+	case 0:
+		return img
+	case 90:
+		return imaging.Rotate270(img) // imaging rotates counter-clockwise
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate90(img)
+	}
+	return imaging.Rotate(img, -deg, bg)
+}
@@ -0,0 +1,71 @@
+package processing
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// IPTC IIM datasets of the application record (record 2) read by this package.
+const (
+	iptcObjectName  = 5
+	iptcKeywords    = 25
+	iptcDateCreated = 55
+	iptcTimeCreated = 60
+	iptcByline      = 80
+	iptcCopyright   = 116
+	iptcCaption     = 120
+)
+
+// parseIPTC fills m from an IPTC-NAA (IIM) record without overwriting fields
+// that are already set.
+func parseIPTC(b []byte, m *EmbeddedMetadata) {
+	var date, clock string
+	var keywords []string
+	for len(b) >= 5 && b[0] == 0x1C {
+		record, dataset := b[1], b[2]
+		n := int(binary.BigEndian.Uint16(b[3:]))
+		if n&0x8000 != 0 || 5+n > len(b) { // extended datasets are not used for text
+			return
+		}
+		v := strings.TrimSpace(string(b[5 : 5+n]))
+		b = b[5+n:]
+		if record != 2 || v == "" {
+			continue
+		}
+		switch dataset {
+		case iptcObjectName:
+			setString(&m.Title, v)
+		case iptcKeywords:
+			keywords = append(keywords, v)
+		case iptcDateCreated:
+			date = v
+		case iptcTimeCreated:
+			clock = v
+		case iptcByline:
+			setString(&m.Artist, v)
+		case iptcCopyright:
+			setString(&m.Copyright, v)
+		case iptcCaption:
+			setString(&m.Description, v)
+		}
+	}
+	if m.Keywords == nil {
+		m.Keywords = keywords
+	}
+	setString(&m.CaptureTime, iptcTime(date, clock))
+}
+
+// iptcTime converts IIM "CCYYMMDD" and "HHMMSS±HHMM" values to ISO 8601.
+func iptcTime(date, clock string) string {
+	if len(date) != 8 {
+		return ""
+	}
+	out := date[:4] + "-" + date[4:6] + "-" + date[6:8]
+	if len(clock) >= 6 {
+		out += "T" + clock[:2] + ":" + clock[2:4] + ":" + clock[4:6]
+		if len(clock) == 11 {
+			out += clock[6:9] + ":" + clock[9:11]
+		}
+	}
+	return out
+}
@@ -0,0 +1,215 @@
+package processing
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// EmbeddedMetadata is the normalized subset of EXIF, IPTC and XMP metadata
+// found in an image file. When sources disagree, EXIF wins over IPTC, which
+// wins over XMP.
+type EmbeddedMetadata struct {
+	CaptureTime  string   `json:"capture_time,omitempty"` // ISO 8601; zone only if recorded
+	Make         string   `json:"make,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	LensModel    string   `json:"lens_model,omitempty"`
+	Software     string   `json:"software,omitempty"`
+	Orientation  int      `json:"orientation,omitempty"`
+	ExposureTime string   `json:"exposure_time,omitempty"` // e.g. "1/250"
+	FNumber      float64  `json:"f_number,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focal_length_mm,omitempty"`
+	Artist       string   `json:"artist,omitempty"`
+	Copyright    string   `json:"copyright,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Keywords     []string `json:"keywords,omitempty"`
+	GPS          *GPS     `json:"gps,omitempty"`
+}
+
+// GPS is a position in decimal degrees; Altitude is in metres above sea level.
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// ExtractMetadata parses the EXIF, IPTC and XMP blocks embedded in a JPEG,
+// PNG, TIFF or WebP file. Missing or malformed metadata yields empty fields;
+// it never fails.
+func ExtractMetadata(b []byte) EmbeddedMetadata {
+	var exif, iptc, xmp []byte
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8}):
+		exif, iptc, xmp, _ = jpegMetadata(b)
+	case bytes.HasPrefix(b, pngSignature):
+		exif, xmp = pngMetadata(b)
+	case bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")):
+		exif = b // a TIFF file's IFD0 carries the same tags
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		exif, xmp = webpMetadata(b)
+	}
+	var m EmbeddedMetadata
+	parseEXIF(exif, &m)
+	parseIPTC(iptc, &m)
+	parseXMP(xmp, &m)
+	return m
+}
+
+// Redacted returns m without the fields that locate the photographer or
+// identify their equipment: GPS, camera make and model, lens and software.
+func (m EmbeddedMetadata) Redacted() EmbeddedMetadata {
+	m.GPS = nil
+	m.Make, m.Model, m.LensModel, m.Software = "", "", "", ""
+	return m
+}
+
+// MetadataComplete reports whether b, the start of a file, holds all the
+// metadata ExtractMetadata would find in the whole file. That is only known
+// for a JPEG whose segments are read up to the first scan; in the other
+// formats metadata may follow the pixel data.
+func MetadataComplete(b []byte) bool {
+	if !bytes.HasPrefix(b, []byte{0xFF, 0xD8}) {
+		return false
+	}
+	_, _, _, scan := jpegMetadata(b)
+	return scan
+}
+
+// jpegMetadata returns the EXIF, IPTC (Photoshop IRB) and XMP payloads from
+// the segments before the first scan, and whether that scan was reached.
+func jpegMetadata(b []byte) (exif, iptc, xmp []byte, scan bool) {
+	const xmpHeader = "http://ns.adobe.com/xap/1.0/\x00"
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		m := b[i+1]
+		if m == 0xFF {
+			i++
+			continue
+		}
+		if m == 0xDA || m == 0xD9 {
+			scan = true
+			break
+		}
+		if m == 0x01 || (m >= 0xD0 && m <= 0xD7) { // standalone markers
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			break
+		}
+		p := b[i+4 : i+2+n]
+		switch {
+		case m == 0xE1 && bytes.HasPrefix(p, []byte(exifHeader)) && exif == nil:
+			exif = p[len(exifHeader):]
+		case m == 0xE1 && bytes.HasPrefix(p, []byte(xmpHeader)) && xmp == nil:
+			xmp = p[len(xmpHeader):]
+		case m == 0xED && bytes.HasPrefix(p, []byte("Photoshop 3.0\x00")) && iptc == nil:
+			iptc = photoshopIPTC(p[len("Photoshop 3.0\x00"):])
+		}
+		i += 2 + n
+	}
+	return exif, iptc, xmp, scan
+}
+
+// photoshopIPTC returns the IPTC-NAA record (resource 0x0404) from a
+// sequence of Photoshop image resource blocks.
+func photoshopIPTC(b []byte) []byte {
+	for len(b) >= 12 && string(b[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(b[4:])
+		nameLen := int(b[6]) + 1 // Pascal string padded to even length
+		nameLen += nameLen & 1
+		if 6+nameLen+4 > len(b) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(b[6+nameLen:]))
+		data := b[6+nameLen+4:]
+		if size > len(data) {
+			return nil
+		}
+		if id == 0x0404 {
+			return data[:size]
+		}
+		size += size & 1
+		if size > len(data) {
+			return nil
+		}
+		b = data[size:]
+	}
+	return nil
+}
+
+// pngMetadata returns the eXIf chunk and the XMP packet stored in an iTXt
+// chunk.
+func pngMetadata(b []byte) (exif, xmp []byte) {
+	for i := len(pngSignature); i+12 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		if n < 0 || i+12+n > len(b) || typ == "IEND" {
+			break
+		}
+		data := b[i+8 : i+8+n]
+		switch typ {
+		case "eXIf":
+			exif = data
+		case "iTXt":
+			if x, ok := itxtXMP(data); ok {
+				xmp = x
+			}
+		}
+		i += 12 + n
+	}
+	return exif, xmp
+}
+
+// itxtXMP returns the text of an iTXt chunk with the XMP keyword.
+// Layout: keyword NUL compression-flag method language NUL translated NUL text.
+func itxtXMP(data []byte) ([]byte, bool) {
+	keyword, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(keyword) != "XML:com.adobe.xmp" || len(rest) < 2 {
+		return nil, false
+	}
+	compressed := rest[0] == 1
+	_, rest, _ = bytes.Cut(rest[2:], []byte{0}) // language
+	_, text, ok := bytes.Cut(rest, []byte{0})   // translated keyword
+	if !ok {
+		return nil, false
+	}
+	if !compressed {
+		return text, true
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(text))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, 1<<20))
+	return out, err == nil
+}
+
+// webpMetadata returns the EXIF and XMP chunks of an extended WebP file.
+func webpMetadata(b []byte) (exif, xmp []byte) {
+	for i := 12; i+8 <= len(b); {
+		n := int(binary.LittleEndian.Uint32(b[i+4:]))
+		if n < 0 || i+8+n > len(b) {
+			break
+		}
+		data := b[i+8 : i+8+n]
+		switch string(b[i : i+4]) {
+		case "EXIF":
+			exif = bytes.TrimPrefix(data, []byte(exifHeader))
+		case "XMP ":
+			xmp = data
+		}
+		i += 8 + n + n&1
+	}
+	return exif, xmp
+}
+
+func setString(dst *string, v string) {
+	if *dst == "" {
+		*dst = v
+	}
+}
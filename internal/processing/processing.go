@@ -5,13 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"image/png"
+	"image/color"
+	"image/gif"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 
 	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/bmp" // register decoders for DetectFormat and image.Decode
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 // SupportedFormat represents a canonical image format name.
@@ -20,47 +24,95 @@ type SupportedFormat string
 const (
 	FormatJPEG SupportedFormat = "jpeg"
 	FormatPNG  SupportedFormat = "png"
+	FormatGIF  SupportedFormat = "gif"
+	FormatBMP  SupportedFormat = "bmp"
+	FormatTIFF SupportedFormat = "tiff"
+	FormatWebP SupportedFormat = "webp"
 )
 
 var errUnsupported = errors.New("unsupported format")
 
+// ErrInvalidOption reports options that cannot be applied to a particular
+// image, such as a frame number past the end of an animation.
+var ErrInvalidOption = errors.New("invalid option")
+
 // DetectFormat tries to detect the image format from bytes using stdlib image.Registered formats.
 func DetectFormat(b []byte) (SupportedFormat, error) {
-	_, format, err := image.DecodeConfig(bytes.NewReader(b))
+	f, _, err := DecodeConfig(bytes.NewReader(b))
+	return f, err
+}
+
+// DecodeConfig reads the format and dimensions of the encoded image in r
+// without decoding pixels. Unlike DetectFormat it can be given a whole stored
+// original, for formats such as TIFF that may place the header at the end.
+func DecodeConfig(r io.Reader) (SupportedFormat, image.Config, error) {
+	cfg, format, err := image.DecodeConfig(r)
 	if err != nil {
-		return "", err
+		return "", cfg, err
 	}
 	switch strings.ToLower(format) {
 	case "jpeg", "jpg":
-		return FormatJPEG, nil
+		return FormatJPEG, cfg, nil
 	case "png":
-		return FormatPNG, nil
+		return FormatPNG, cfg, nil
+	case "gif":
+		return FormatGIF, cfg, nil
+	case "bmp":
+		return FormatBMP, cfg, nil
+	case "tiff":
+		return FormatTIFF, cfg, nil
+	case "webp":
+		return FormatWebP, cfg, nil
 	default:
-		return "", fmt.Errorf("%w: %s", errUnsupported, format)
+		return "", cfg, fmt.Errorf("%w: %s", errUnsupported, format)
 	}
 }
 
+// ContentType returns the MIME type for f, or application/octet-stream if unknown.
+func ContentType(f SupportedFormat) string {
+	switch f {
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatPNG:
+		return "image/png"
+	case FormatGIF:
+		return "image/gif"
+	case FormatBMP:
+		return "image/bmp"
+	case FormatTIFF:
+		return "image/tiff"
+	case FormatWebP:
+		return "image/webp"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// canEncode reports whether Process can produce f as output.
+func canEncode(f SupportedFormat) bool {
+	switch f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatBMP, FormatTIFF:
+		return true
+	}
+	return false
+}
+
+// Dimensions returns the pixel size of an encoded image by reading its header.
+func Dimensions(b []byte) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
 // Transcode converts image bytes to the requested target format.
 func Transcode(in []byte, target SupportedFormat) ([]byte, string, error) {
 	img, _, err := image.Decode(bytes.NewReader(in))
 	if err != nil {
 		return nil, "", err
 	}
-	var buf bytes.Buffer
-	switch target {
-	case FormatJPEG:
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
-			return nil, "", err
-		}
-		return buf.Bytes(), "image/jpeg", nil
-	case FormatPNG:
-		if err := png.Encode(&buf, img); err != nil {
-			return nil, "", err
-		}
-		return buf.Bytes(), "image/png", nil
-	default:
-		return nil, "", errUnsupported
-	}
+	return encode(img, target, Options{})
 }
 
 // CopyLimit copies up to n bytes from r to a buffer; returns error if exceeded.
@@ -79,17 +131,157 @@ func CopyLimit(r io.Reader, n int64) ([]byte, error) {
 
 // Options define processing/transformation parameters.
 type Options struct {
-	Target    SupportedFormat // "jpeg" or "png"; empty means keep original
+	Target    SupportedFormat // jpeg, png, gif, bmp or tiff; empty means keep original (PNG if not encodable)
 	Quality   int             // 1-100 for JPEG; 0 means default 85
 	Grayscale bool
-	Width     int  // resize/thumbnail width if > 0
-	Height    int  // resize/thumbnail height if > 0
-	Thumbnail bool // if true and both dims specified, do center-crop thumbnail
+	Width     int         // resize/thumbnail width if > 0
+	Height    int         // resize/thumbnail height if > 0
+	Thumbnail bool        // if true and both dims specified, do center-crop thumbnail (same as Fit cover)
+	Fit       string      // how to resize to both Width and Height: one of the Fit* modes; default fill
+	Gravity   string      // anchor for cover crops and padding; see ParseGravity. Default center
+	Focal     *FocalPoint // centre of cover crops; takes precedence over Gravity
+
+	Colors      int    // GIF palette size 2-256; 0 means 256
+	NoDither    bool   // GIF: map to the palette without Floyd-Steinberg dithering
+	Compression string // TIFF: CompressionDeflate (default) or CompressionNone
+
+	Frame    int  // 1-based frame of an animation to extract as a still; 0 keeps every frame
+	NoOrient bool // ignore the EXIF orientation instead of rotating/flipping upright
+
+	Crop       Crop        // region to keep, measured on the upright source
+	Rotate     float64     // clockwise rotation in degrees
+	FlipH      bool        // mirror left to right
+	FlipV      bool        // mirror top to bottom
+	Background color.NRGBA // fill for areas not covered by the image; zero is transparent
+
+	// Filters, applied in the order listed by applyFilters and applyDetail.
+	Brightness float64 // -100 to 100 percent
+	Contrast   float64 // -100 to 100 percent
+	Gamma      float64 // 0.1 to 10; 0 or 1 leaves the image unchanged
+	Saturation float64 // -100 to 100 percent
+	Hue        float64 // rotation in degrees, -360 to 360
+	Sepia      float64 // 0 to 100 percent
+	Invert     bool
+	Blur       float64 // Gaussian blur sigma in output pixels, 0 to 50
+	Sharpen    float64 // sharpening sigma in output pixels, 0 to 10
+
+	Watermark *Watermark // composited over the output after resizing
+
+	// coverWindow, if set, is the region cover crops keep instead of one
+	// placed by Focal or Gravity, so the frames of an animation share it.
+	coverWindow *image.Rectangle
 }
 
 // IsNoop returns true if the options request no transformation and no target change.
 func (o Options) IsNoop() bool {
-	return !o.Grayscale && o.Width == 0 && o.Height == 0 && o.Thumbnail == false && o.Target == ""
+	return !o.hasFilters() && o.Watermark == nil && o.Width == 0 && o.Height == 0 && o.Thumbnail == false && o.Target == "" && o.Frame == 0 &&
+		o.Crop.IsZero() && normalizeAngle(o.Rotate) == 0 && !o.FlipH && !o.FlipV
+}
+
+// Key returns a canonical encoding of the options: two Options that produce the
+// same output encode identically, so the key can address cached variants.
+func (o Options) Key() string {
+	var b strings.Builder
+	b.WriteString("v2")
+	if o.Target != "" {
+		b.WriteString(";t=" + string(o.Target))
+	}
+	if o.Target == FormatJPEG || o.Target == "" { // "" may keep a JPEG original
+		q := o.Quality
+		if q <= 0 || q > 100 {
+			q = 85
+		}
+		fmt.Fprintf(&b, ";q=%d", q)
+	}
+	if o.Target == FormatGIF || o.Target == "" {
+		if o.Colors > 0 && o.Colors < 256 {
+			fmt.Fprintf(&b, ";c=%d", o.Colors)
+		}
+		if o.NoDither {
+			b.WriteString(";nodither")
+		}
+	}
+	if (o.Target == FormatTIFF || o.Target == "") && o.Compression == CompressionNone {
+		b.WriteString(";z=none")
+	}
+	if o.Frame > 0 {
+		fmt.Fprintf(&b, ";f=%d", o.Frame)
+	}
+	if o.NoOrient {
+		b.WriteString(";noorient")
+	}
+	if !o.Crop.IsZero() {
+		b.WriteString(";crop=" + o.Crop.String())
+	}
+	if deg := normalizeAngle(o.Rotate); deg != 0 {
+		b.WriteString(";rot=" + strconv.FormatFloat(deg, 'f', -1, 64))
+	}
+	if o.FlipH {
+		b.WriteString(";fliph")
+	}
+	if o.FlipV {
+		b.WriteString(";flipv")
+	}
+	if o.Background != (color.NRGBA{}) {
+		b.WriteString(";bg=" + colorString(o.Background))
+	}
+	o.writeFilterKey(&b)
+	if o.Width > 0 {
+		fmt.Fprintf(&b, ";w=%d", o.Width)
+	}
+	if o.Height > 0 {
+		fmt.Fprintf(&b, ";h=%d", o.Height)
+	}
+	if o.Width > 0 && o.Height > 0 {
+		if fit := o.fit(); fit != FitFill {
+			b.WriteString(";fit=" + fit)
+			if o.Focal != nil && fit == FitCover {
+				b.WriteString(";fp=" + strconv.FormatFloat(o.Focal.X, 'f', -1, 64) + "," + strconv.FormatFloat(o.Focal.Y, 'f', -1, 64))
+			} else if g := o.gravity(); g != GravityCenter && fit != FitInside && fit != FitOutside {
+				b.WriteString(";g=" + g)
+			}
+		}
+	}
+	o.writeDetailKey(&b)
+	if o.Watermark != nil {
+		b.WriteString(";wm=" + o.Watermark.key())
+	}
+	return b.String()
+}
+
+// Validate reports format options outside their accepted range.
+func (o Options) Validate() error {
+	if o.Colors != 0 && (o.Colors < 2 || o.Colors > 256) {
+		return fmt.Errorf("colors must be between 2 and 256")
+	}
+	if o.Frame < 0 {
+		return fmt.Errorf("frame must be a positive integer")
+	}
+	if math.IsNaN(o.Rotate) || math.IsInf(o.Rotate, 0) {
+		return fmt.Errorf("rotate must be a number of degrees")
+	}
+	if o.Focal != nil && !o.Focal.Valid() {
+		return fmt.Errorf("focal point must be x,y between 0 and 1")
+	}
+	if err := o.validateFilters(); err != nil {
+		return err
+	}
+	if o.Watermark != nil {
+		if err := o.Watermark.validate(); err != nil {
+			return err
+		}
+	}
+	switch o.Fit {
+	case "", FitFill, FitCover, FitContain, FitInside, FitOutside, FitPad:
+	default:
+		return fmt.Errorf("fit must be one of %s, %s, %s, %s, %s or %s", FitCover, FitContain, FitFill, FitInside, FitOutside, FitPad)
+	}
+	switch o.Compression {
+	case "", CompressionDeflate, CompressionNone:
+	default:
+		return fmt.Errorf("compression must be %q or %q", CompressionDeflate, CompressionNone)
+	}
+	return nil
 }
 
 // ParseBool accepts "1", "true", "yes" as true (case-insensitive).
@@ -112,65 +304,111 @@ func Process(in []byte, opts Options) ([]byte, string, error) {
 		if err != nil {
 			return in, "application/octet-stream", nil
 		}
-		switch f {
-		case FormatJPEG:
-			return in, "image/jpeg", nil
-		case FormatPNG:
-			return in, "image/png", nil
-		default:
-			return in, "application/octet-stream", nil
-		}
+		return in, ContentType(f), nil
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(in))
-	if err != nil {
-		return nil, "", err
-	}
-
-	// filters
-	if opts.Grayscale {
-		img = imaging.Grayscale(img)
-	}
-
-	// resizing
-	if opts.Width > 0 || opts.Height > 0 {
-		if opts.Thumbnail && opts.Width > 0 && opts.Height > 0 {
-			img = imaging.Thumbnail(img, opts.Width, opts.Height, imaging.Lanczos)
-		} else {
-			w := opts.Width
-			h := opts.Height
-			img = imaging.Resize(img, w, h, imaging.Lanczos)
-		}
-	}
+	src, _ := DetectFormat(in)
 
 	// choose output format
 	target := opts.Target
 	if target == "" {
-		// keep original
-		if f, err := DetectFormat(in); err == nil {
-			target = f
+		// keep original when we can encode it, PNG otherwise (e.g. WebP input)
+		if canEncode(src) {
+			target = src
 		} else {
 			target = FormatPNG
 		}
 	}
 
-	var buf bytes.Buffer
-	switch target {
-	case FormatJPEG:
-		q := opts.Quality
-		if q <= 0 || q > 100 {
-			q = 85
+	var img image.Image
+	if src == FormatGIF {
+		// check the frames that will be coalesced before decoding any
+		frames := gifFrameCount(in)
+		animated := frames > 1 && target == FormatGIF && opts.Frame == 0
+		n := max(opts.Frame, 1)
+		if animated {
+			n = frames
 		}
-		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+		if err := checkGIFSize(in, min(n, max(frames, 1))); err != nil {
 			return nil, "", err
 		}
-		return buf.Bytes(), "image/jpeg", nil
-	case FormatPNG:
-		if err := png.Encode(&buf, img); err != nil {
+		g, err := gif.DecodeAll(bytes.NewReader(in))
+		if err != nil {
 			return nil, "", err
 		}
-		return buf.Bytes(), "image/png", nil
-	default:
-		return nil, "", errUnsupported
+		if animated {
+			return encodeAnimated(g, opts)
+		}
+		if n > len(g.Image) {
+			return nil, "", fmt.Errorf("%w: frame %d of %d", ErrInvalidOption, n, len(g.Image))
+		}
+		coalesce(g, n, func(i int, screen *image.NRGBA) {
+			if i == n-1 {
+				img = screen
+			}
+		})
+	} else {
+		// imaging applies the EXIF orientation before any other transform
+		var err error
+		if img, err = imaging.Decode(bytes.NewReader(in), imaging.AutoOrientation(!opts.NoOrient)); err != nil {
+			return nil, "", err
+		}
+		if opts.Frame > 1 {
+			return nil, "", fmt.Errorf("%w: frame %d of 1", ErrInvalidOption, opts.Frame)
+		}
+	}
+
+	img, err := transform(img, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return encode(img, target, opts)
+}
+
+// transform applies the pixel operations in opts to a single image, in this
+// order: crop, rotate, flip, colour filters (see applyFilters), resize, blur
+// and sharpen, watermark. Orientation has already been corrected on decode,
+// so crop coordinates refer to the image as displayed.
+func transform(img image.Image, opts Options) (image.Image, error) {
+	img, err := prepare(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	return finish(img, opts)
+}
+
+// prepare runs the steps of transform before resizing.
+func prepare(img image.Image, opts Options) (image.Image, error) {
+	// geometry
+	if !opts.Crop.IsZero() {
+		r := opts.Crop.rect(img.Bounds())
+		if r.Empty() {
+			return nil, fmt.Errorf("%w: crop %s lies outside the %dx%d image", ErrInvalidOption, opts.Crop, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+		img = imaging.Crop(img, r)
+	}
+	img = rotate(img, opts.Rotate, opts.Background)
+	if opts.FlipH {
+		img = imaging.FlipH(img)
+	}
+	if opts.FlipV {
+		img = imaging.FlipV(img)
+	}
+
+	return applyFilters(img, opts), nil
+}
+
+// finish runs the steps of transform from resizing on.
+func finish(img image.Image, opts Options) (image.Image, error) {
+	// resizing
+	if opts.Width > 0 || opts.Height > 0 {
+		img = resizeTo(img, opts.Width, opts.Height, opts)
+	}
+	img = applyDetail(img, opts)
+
+	// overlays
+	if opts.Watermark != nil {
+		return applyWatermark(img, opts.Watermark)
 	}
+	return img, nil
 }
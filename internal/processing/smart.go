@@ -0,0 +1,182 @@
+package processing
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// GravitySmart selects cover crops by image content instead of a fixed anchor.
+const GravitySmart = "smart"
+
+// smartAnalysisSize is the longest side, in pixels, of the downscaled copy
+// that smart cropping scores. It bounds the cost independently of the input.
+const smartAnalysisSize = 256
+
+// Weights of the per-pixel features and of window entropy in the crop score.
+const (
+	smartEdgeWeight       = 1.0
+	smartSkinWeight       = 1.8
+	smartSaturationWeight = 0.4
+	smartEntropyWeight    = 0.5
+	smartCenterBias       = 0.05 // fraction of the score lost at the far edge
+)
+
+// smartRect returns the position of a size-sized window inside the bounds of
+// frames that scores highest for edge energy, skin tones, saturation and
+// luminance entropy, summed over all frames so an animation gets one window
+// that follows its subject throughout. Frames must share their bounds. Only
+// one axis is free because cover crops span the full width or height. The
+// result depends only on the pixels, so it is deterministic.
+func smartRect(frames []image.Image, size image.Point) image.Rectangle {
+	b := frames[0].Bounds()
+	free := b.Size().Sub(size)
+	if free.X <= 0 && free.Y <= 0 {
+		return image.Rectangle{Min: b.Min, Max: b.Min.Add(size)}
+	}
+
+	scale := math.Min(1, float64(smartAnalysisSize)/float64(max(b.Dx(), b.Dy())))
+	aw, ah := max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale))
+
+	// Scores are summed along the fixed axis into lines (columns when sliding
+	// horizontally, rows when sliding vertically) so each window is a run of
+	// consecutive lines.
+	horizontal := free.X > 0
+	lines, span := aw, ah
+	if !horizontal {
+		lines, span = ah, aw
+	}
+	winLen := int(math.Round(float64(lines) * float64(sizeAlong(size, horizontal)) / float64(sizeAlong(b.Size(), horizontal))))
+	winLen = min(max(winLen, 1), lines)
+
+	lineScore := make([]float64, lines)
+	lineHist := make([][16]int, lines)
+	for _, img := range frames {
+		feat, lum := smartFeatures(imaging.Resize(img, aw, ah, imaging.Box))
+		for i := 0; i < lines; i++ {
+			for j := 0; j < span; j++ {
+				p := j*aw + i
+				if !horizontal {
+					p = i*aw + j
+				}
+				lineScore[i] += feat[p]
+				lineHist[i][lum[p]>>4]++
+			}
+		}
+	}
+	span *= len(frames) // samples per line, across all frames
+
+	var sum float64
+	var hist [16]int
+	for i := 0; i < winLen; i++ {
+		sum += lineScore[i]
+		addHist(&hist, lineHist[i], 1)
+	}
+	best, bestScore := 0, math.Inf(-1)
+	last := lines - winLen
+	for start := 0; ; start++ {
+		area := float64(winLen * span)
+		score := sum/area + smartEntropyWeight*entropy(hist[:], winLen*span)/4
+		if last > 0 {
+			dist := math.Abs(float64(start)/float64(last)-0.5) * 2
+			score *= 1 - smartCenterBias*dist
+		}
+		if score > bestScore {
+			best, bestScore = start, score
+		}
+		if start == last {
+			break
+		}
+		sum += lineScore[start+winLen] - lineScore[start]
+		addHist(&hist, lineHist[start+winLen], 1)
+		addHist(&hist, lineHist[start], -1)
+	}
+
+	// map the analysis position back to source pixels
+	off := image.Point{}
+	if horizontal {
+		off.X = min(free.X, int(math.Round(float64(best)/scale)))
+	} else {
+		off.Y = min(free.Y, int(math.Round(float64(best)/scale)))
+	}
+	return image.Rectangle{Min: b.Min.Add(off), Max: b.Min.Add(off).Add(size)}
+}
+
+func sizeAlong(p image.Point, horizontal bool) int {
+	if horizontal {
+		return p.X
+	}
+	return p.Y
+}
+
+// smartFeatures returns a per-pixel interest score and luminance for img.
+func smartFeatures(img *image.NRGBA) ([]float64, []uint8) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	lum := make([]uint8, w*h)
+	feat := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := img.Pix[y*img.Stride+4*x:]
+			r, g, bl := float64(px[0]), float64(px[1]), float64(px[2])
+			lum[y*w+x] = uint8(0.299*r + 0.587*g + 0.114*bl)
+			feat[y*w+x] = smartSkinWeight*skin(r, g, bl) + smartSaturationWeight*saturation(r, g, bl)
+		}
+	}
+	// edge energy: gradient magnitude of luminance
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := float64(lum[y*w+x])
+			var dx, dy float64
+			if x+1 < w {
+				dx = float64(lum[y*w+x+1]) - l
+			}
+			if y+1 < h {
+				dy = float64(lum[(y+1)*w+x]) - l
+			}
+			feat[y*w+x] += smartEdgeWeight * math.Min(1, math.Hypot(dx, dy)/64)
+		}
+	}
+	return feat, lum
+}
+
+// skin scores how much an RGB colour resembles human skin, in [0, 1].
+func skin(r, g, b float64) float64 {
+	if r < 95 || g < 40 || b < 20 || r <= g || r <= b || r-g < 15 {
+		return 0
+	}
+	if math.Max(r, math.Max(g, b))-math.Min(r, math.Min(g, b)) < 15 {
+		return 0
+	}
+	// favour the typical hue ratio g/r of about 0.7
+	return math.Max(0, 1-math.Abs(g/r-0.7)*3)
+}
+
+// saturation returns HSV saturation weighted by brightness, in [0, 1], so
+// dark near-black pixels do not count as colourful.
+func saturation(r, g, b float64) float64 {
+	hi := math.Max(r, math.Max(g, b))
+	if hi == 0 {
+		return 0
+	}
+	lo := math.Min(r, math.Min(g, b))
+	return (hi - lo) / hi * hi / 255
+}
+
+func addHist(dst *[16]int, src [16]int, sign int) {
+	for i := range dst {
+		dst[i] += sign * src[i]
+	}
+}
+
+// entropy returns the Shannon entropy in bits of a histogram of n samples.
+func entropy(hist []int, n int) float64 {
+	var e float64
+	for _, c := range hist {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
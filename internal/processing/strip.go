@@ -0,0 +1,251 @@
+package processing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// StripPolicy selects the metadata StripMetadata keeps. Everything else that
+// can identify the camera, owner or location is removed.
+type StripPolicy struct {
+	KeepICC         bool // keep embedded ICC colour profiles
+	KeepOrientation bool // keep the EXIF orientation as a minimal EXIF block
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// StripMetadata copies an encoded image from src to dst, dropping metadata
+// segments without re-encoding pixels: APPn and COM segments from JPEG and
+// textual, EXIF and (unless kept) ICC chunks from PNG. The JFIF and Adobe
+// segments, which affect how JPEG pixels decode, are always kept. Other
+// formats are copied unchanged. It returns the kinds of metadata removed,
+// e.g. "exif", "xmp", "iptc", "icc", "comment" or "text".
+func StripMetadata(dst io.Writer, src io.Reader, p StripPolicy) ([]string, error) {
+	br := bufio.NewReaderSize(src, 64<<10)
+	bw := bufio.NewWriterSize(dst, 64<<10)
+	var rm removedSet
+	var err error
+	sig, _ := br.Peek(len(pngSignature))
+	switch {
+	case bytes.HasPrefix(sig, []byte{0xFF, 0xD8}):
+		err = stripJPEG(bw, br, p, &rm)
+	case bytes.Equal(sig, pngSignature):
+		err = stripPNG(bw, br, p, &rm)
+	}
+	// whatever the strippers left (image data, or all of an unknown format)
+	// is copied verbatim
+	if err == nil {
+		_, err = io.Copy(bw, br)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return rm, err
+}
+
+// removedSet lists removed metadata kinds in order of first occurrence.
+type removedSet []string
+
+func (s *removedSet) add(kind string) {
+	for _, k := range *s {
+		if k == kind {
+			return
+		}
+	}
+	*s = append(*s, kind)
+}
+
+// stripJPEG filters the segments before the first scan. It returns nil at the
+// start of scan data or at anything it does not understand, leaving the rest
+// of r to be copied unchanged.
+func stripJPEG(w io.Writer, r *bufio.Reader, p StripPolicy, rm *removedSet) error {
+	if _, err := io.CopyN(w, r, 2); err != nil { // SOI
+		return readErr(err)
+	}
+	for {
+		hdr, err := r.Peek(4)
+		if len(hdr) < 2 || hdr[0] != 0xFF {
+			return readErr(err)
+		}
+		m := hdr[1]
+		switch {
+		case m == 0xFF: // fill byte
+			if _, err := io.CopyN(w, r, 1); err != nil {
+				return readErr(err)
+			}
+			continue
+		case m == 0xDA || m == 0xD9: // SOS, EOI
+			return nil
+		case m == 0x01 || (m >= 0xD0 && m <= 0xD7): // standalone markers
+			if _, err := io.CopyN(w, r, 2); err != nil {
+				return readErr(err)
+			}
+			continue
+		}
+		if len(hdr) < 4 {
+			return readErr(err)
+		}
+		n := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if n < 2 {
+			return nil
+		}
+		if !(m >= 0xE0 && m <= 0xEF) && m != 0xFE {
+			if _, err := io.CopyN(w, r, 2+n); err != nil {
+				return readErr(err)
+			}
+			continue
+		}
+
+		seg := make([]byte, 2+n)
+		if k, err := io.ReadFull(r, seg); err != nil {
+			_, _ = w.Write(seg[:k])
+			return readErr(err)
+		}
+		payload := seg[4:]
+		var kind string
+		var replacement []byte
+		switch {
+		case m == 0xE0 && (bytes.HasPrefix(payload, []byte("JFIF\x00")) || bytes.HasPrefix(payload, []byte("JFXX\x00"))),
+			m == 0xEE && bytes.HasPrefix(payload, []byte("Adobe")),
+			m == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")) && p.KeepICC:
+			// keep
+		case m == 0xE1 && bytes.HasPrefix(payload, []byte(exifHeader)):
+			kind = "exif"
+			if o := exifOrientation(payload[len(exifHeader):]); p.KeepOrientation && o > 1 {
+				replacement = jpegSegment(0xE1, append([]byte(exifHeader), orientationEXIF(o)...))
+			}
+		case m == 0xE1 && bytes.HasPrefix(payload, []byte("http://ns.adobe.com/x")):
+			kind = "xmp"
+		case m == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			kind = "icc"
+		case m == 0xED && bytes.HasPrefix(payload, []byte("Photoshop 3.0\x00")):
+			kind = "iptc"
+		case m == 0xFE:
+			kind = "comment"
+		default:
+			kind = fmt.Sprintf("app%d", m-0xE0)
+		}
+		if kind == "" {
+			replacement = seg
+		} else {
+			rm.add(kind)
+		}
+		if _, err := w.Write(replacement); err != nil {
+			return err
+		}
+	}
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	n := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(n >> 8), byte(n)}, payload...)
+}
+
+// stripPNG filters PNG chunks up to and including IEND.
+func stripPNG(w io.Writer, r *bufio.Reader, p StripPolicy, rm *removedSet) error {
+	if _, err := io.CopyN(w, r, int64(len(pngSignature))); err != nil {
+		return readErr(err)
+	}
+	for {
+		hdr, err := r.Peek(8)
+		if len(hdr) < 8 {
+			return readErr(err)
+		}
+		n := int64(binary.BigEndian.Uint32(hdr))
+		typ := string(hdr[4:8])
+		switch typ {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "iCCP":
+		default:
+			if _, err := io.CopyN(w, r, 12+n); err != nil {
+				return readErr(err)
+			}
+			if typ == "IEND" {
+				return nil
+			}
+			continue
+		}
+
+		// The declared length is untrusted, so chunks are streamed or read no
+		// further than the data actually present. A chunk that runs past the
+		// end of the stream is dropped with the rest of it.
+		var kind string
+		var replacement []byte
+		consumed := false
+		switch typ {
+		case "iCCP":
+			if p.KeepICC {
+				if _, err := io.CopyN(w, r, 12+n); err != nil {
+					return readErr(err)
+				}
+				continue
+			}
+			kind = "icc"
+		case "eXIf":
+			kind = "exif"
+			if p.KeepOrientation {
+				chunk, err := io.ReadAll(io.LimitReader(r, 12+n))
+				if err != nil {
+					return err
+				}
+				if int64(len(chunk)) < 12+n {
+					rm.add(kind)
+					return nil
+				}
+				consumed = true
+				if o := exifOrientation(chunk[8 : 8+n]); o > 1 {
+					replacement = pngChunk("eXIf", orientationEXIF(o))
+				}
+			}
+		default:
+			// the keyword is at most 79 bytes and its terminator
+			hdr, _ := r.Peek(8 + int(min(n, 80)))
+			kind = textChunkKind(hdr[8:])
+		}
+		rm.add(kind)
+		if !consumed {
+			if _, err := io.CopyN(io.Discard, r, 12+n); err != nil {
+				return readErr(err)
+			}
+		}
+		if _, err := w.Write(replacement); err != nil {
+			return err
+		}
+	}
+}
+
+// textChunkKind classifies a tEXt/zTXt/iTXt chunk by its keyword. Tools such
+// as ImageMagick store raw EXIF, IPTC and XMP profiles in text chunks.
+func textChunkKind(data []byte) string {
+	keyword, _, _ := bytes.Cut(data, []byte{0})
+	switch string(keyword) {
+	case "XML:com.adobe.xmp", "Raw profile type xmp":
+		return "xmp"
+	case "Raw profile type exif", "Raw profile type APP1":
+		return "exif"
+	case "Raw profile type iptc", "Raw profile type 8bim":
+		return "iptc"
+	}
+	return "text"
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+// readErr treats a truncated stream as the end of the structure to filter;
+// whatever was read is kept and the remainder copied verbatim.
+func readErr(err error) error {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package processing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrTooLarge is returned by UploadReader once the stream exceeds its limit.
+var ErrTooLarge = errors.New("payload too large")
+
+// sniffLen is how much of an upload UploadReader keeps for format detection.
+// It covers the headers DecodeConfig needs for JPEG (after APPn segments),
+// PNG, GIF and WebP, but not TIFF files whose IFD follows the pixel data;
+// callers fall back to DecodeConfig on the stored original for those.
+const sniffLen = 256 << 10
+
+// UploadReader wraps an upload stream so it can be copied straight into
+// storage: it enforces a size limit, hashes the bytes with SHA-256 and keeps
+// the leading bytes for format sniffing, without buffering the whole body.
+type UploadReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	hash  hash.Hash
+	head  []byte
+}
+
+// NewUploadReader returns an UploadReader over r. A limit <= 0 disables the size check.
+func NewUploadReader(r io.Reader, limit int64) *UploadReader {
+	return &UploadReader{r: r, limit: limit, hash: sha256.New()}
+}
+
+// Read implements io.Reader. It fails with ErrTooLarge as soon as more than
+// limit bytes have been read.
+func (u *UploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if n > 0 {
+		u.n += int64(n)
+		if u.limit > 0 && u.n > u.limit {
+			return 0, fmt.Errorf("%w: limit %d bytes", ErrTooLarge, u.limit)
+		}
+		u.hash.Write(p[:n])
+		if room := sniffLen - len(u.head); room > 0 {
+			u.head = append(u.head, p[:min(n, room)]...)
+		}
+	}
+	return n, err
+}
+
+// Size returns the number of bytes read so far.
+func (u *UploadReader) Size() int64 { return u.n }
+
+// Sum returns the hex SHA-256 of the bytes read so far.
+func (u *UploadReader) Sum() string { return hex.EncodeToString(u.hash.Sum(nil)) }
+
+// Head returns the leading bytes of the stream, suitable for DetectFormat
+// and image.DecodeConfig.
+func (u *UploadReader) Head() []byte { return u.head }
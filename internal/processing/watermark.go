@@ -0,0 +1,113 @@
+package processing
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Watermark defaults applied by callers when a request leaves them out.
+const (
+	DefaultWatermarkGravity = "se"
+	DefaultWatermarkScale   = 0.25
+)
+
+// Watermark is an image composited over the output after resizing.
+type Watermark struct {
+	ID      string      // stored image ID of the watermark
+	Version string      // checksum of the watermark image; part of the cache key
+	Image   image.Image // decoded watermark; must be set before Process
+
+	Gravity string  // position on the output; see ParseGravity. Ignored when tiling
+	Margin  int     // distance from the edges, and between tiles, in output pixels
+	Scale   float64 // fits the watermark in this fraction of the output size, 0 to 1
+	Opacity float64 // 0 (invisible) to 1 (as drawn)
+	Tile    bool    // repeat the watermark over the whole output
+}
+
+// DecodeWatermark decodes a stored image for use as Watermark.Image.
+func DecodeWatermark(b []byte) (image.Image, error) {
+	return imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+}
+
+func (w *Watermark) validate() error {
+	if w.ID == "" {
+		return fmt.Errorf("watermark needs an image ID")
+	}
+	if !(w.Scale > 0 && w.Scale <= 1) {
+		return fmt.Errorf("watermark scale must be greater than 0 and at most 1")
+	}
+	if !(w.Opacity >= 0 && w.Opacity <= 1) {
+		return fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+	if w.Margin < 0 {
+		return fmt.Errorf("watermark margin must not be negative")
+	}
+	if w.Gravity == GravitySmart {
+		return fmt.Errorf("watermark position cannot be %s", GravitySmart)
+	}
+	return nil
+}
+
+func (w *Watermark) key() string {
+	var b strings.Builder
+	b.WriteString(w.ID + "@" + w.Version)
+	fmt.Fprintf(&b, ",s=%s,o=%s,m=%d",
+		strconv.FormatFloat(w.Scale, 'f', -1, 64), strconv.FormatFloat(w.Opacity, 'f', -1, 64), w.Margin)
+	if w.Tile {
+		b.WriteString(",tile")
+	} else {
+		b.WriteString(",g=" + w.gravity())
+	}
+	return b.String()
+}
+
+func (w *Watermark) gravity() string {
+	if w.Gravity == "" {
+		return DefaultWatermarkGravity
+	}
+	return w.Gravity
+}
+
+// applyWatermark composites w over img. The watermark keeps its aspect ratio
+// and is scaled to fit w.Scale of img's width and height, so it stays the
+// same relative size whatever the output dimensions.
+func applyWatermark(img image.Image, w *Watermark) (image.Image, error) {
+	if w.Image == nil {
+		return nil, fmt.Errorf("watermark %s not loaded", w.ID)
+	}
+	b := img.Bounds()
+	wb := w.Image.Bounds()
+	if b.Empty() || wb.Empty() {
+		return img, nil
+	}
+	s := w.Scale * math.Min(float64(b.Dx())/float64(wb.Dx()), float64(b.Dy())/float64(wb.Dy()))
+	mark := imaging.Resize(w.Image, max(1, int(math.Round(float64(wb.Dx())*s))), max(1, int(math.Round(float64(wb.Dy())*s))), imaging.Lanczos)
+	size := mark.Bounds().Size()
+
+	if !w.Tile {
+		// drop the margin when the watermark would not fit inside it
+		off := anchorOffset(b.Size(), size, w.gravity())
+		if area := b.Size().Sub(image.Pt(2*w.Margin, 2*w.Margin)); size.X <= area.X && size.Y <= area.Y {
+			off = anchorOffset(area, size, w.gravity()).Add(image.Pt(w.Margin, w.Margin))
+		}
+		return imaging.Overlay(img, mark, b.Min.Add(off), w.Opacity), nil
+	}
+
+	// draw every tile into one layer so opacity is applied in a single pass
+	layer := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	step := size.Add(image.Pt(w.Margin, w.Margin))
+	for y := w.Margin; y < b.Dy(); y += step.Y {
+		for x := w.Margin; x < b.Dx(); x += step.X {
+			r := image.Rectangle{Min: image.Pt(x, y), Max: image.Pt(x, y).Add(size)}
+			draw.Draw(layer, r, mark, image.Point{}, draw.Over)
+		}
+	}
+	return imaging.Overlay(img, layer, b.Min, w.Opacity), nil
+}
@@ -0,0 +1,123 @@
+package processing
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// XMP namespaces read by this package.
+const (
+	nsRDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC        = "http://purl.org/dc/elements/1.1/"
+	nsXMP       = "http://ns.adobe.com/xap/1.0/"
+	nsEXIF      = "http://ns.adobe.com/exif/1.0/"
+	nsEXIFEX    = "http://cipa.jp/exif/1.0/"
+	nsAux       = "http://ns.adobe.com/exif/1.0/aux/"
+	nsTIFF      = "http://ns.adobe.com/tiff/1.0/"
+	nsPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+)
+
+// parseXMP fills m from an XMP packet without overwriting fields that are
+// already set. Properties may be written as attributes of rdf:Description or
+// as elements, optionally holding an rdf:Alt, rdf:Seq or rdf:Bag of rdf:li.
+func parseXMP(b []byte, m *EmbeddedMetadata) {
+	if len(b) == 0 {
+		return
+	}
+	props := map[string][]string{}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	var stack []xml.Name
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			for _, a := range t.Attr {
+				if a.Name.Space != nsRDF && a.Name.Space != "xmlns" && a.Name.Space != "" {
+					props[a.Name.Space+a.Name.Local] = append(props[a.Name.Space+a.Name.Local], a.Value)
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			v := strings.TrimSpace(string(t))
+			if v == "" {
+				continue
+			}
+			// attribute the text to the innermost non-RDF element
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].Space != nsRDF {
+					key := stack[i].Space + stack[i].Local
+					props[key] = append(props[key], v)
+					break
+				}
+			}
+		}
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := props[k]; len(v) > 0 {
+				return v[0]
+			}
+		}
+		return ""
+	}
+
+	setString(&m.CaptureTime, first(nsEXIF+"DateTimeOriginal", nsPhotoshop+"DateCreated", nsXMP+"CreateDate"))
+	setString(&m.Make, first(nsTIFF+"Make"))
+	setString(&m.Model, first(nsTIFF+"Model"))
+	setString(&m.LensModel, first(nsEXIFEX+"LensModel", nsAux+"Lens"))
+	setString(&m.Software, first(nsXMP+"CreatorTool", nsTIFF+"Software"))
+	setString(&m.Artist, strings.Join(props[nsDC+"creator"], ", "))
+	setString(&m.Copyright, first(nsDC+"rights"))
+	setString(&m.Title, first(nsDC+"title"))
+	setString(&m.Description, first(nsDC+"description"))
+	if m.Keywords == nil {
+		m.Keywords = props[nsDC+"subject"]
+	}
+	if m.Orientation == 0 {
+		if o, err := strconv.Atoi(first(nsTIFF + "Orientation")); err == nil && o >= 1 && o <= 8 {
+			m.Orientation = o
+		}
+	}
+	if m.GPS == nil {
+		lat, latOK := xmpCoordinate(first(nsEXIF+"GPSLatitude"), 'S')
+		lon, lonOK := xmpCoordinate(first(nsEXIF+"GPSLongitude"), 'W')
+		if latOK && lonOK {
+			m.GPS = &GPS{Latitude: lat, Longitude: lon}
+		}
+	}
+}
+
+// xmpCoordinate parses an XMP GPS coordinate, "DDD,MM.mmk" or "DDD,MM,SSk"
+// where k is the hemisphere letter, into signed decimal degrees.
+func xmpCoordinate(s string, neg byte) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	ref := s[len(s)-1]
+	parts := strings.Split(s[:len(s)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var v float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0, false
+		}
+		v += f / []float64{1, 60, 3600}[i]
+	}
+	if ref == neg || ref == neg+('a'-'A') {
+		v = -v
+	}
+	return round(v, 6), true
+}
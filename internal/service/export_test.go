@@ -0,0 +1,5 @@
+package service
+
+// FlightWaiters reports how many callers are waiting on another caller's
+// in-flight transformation.
+func (s *Service) FlightWaiters() int { return s.flight.waiting() }
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flightGroup collapses concurrent calls with the same key into one execution
+// whose result is handed to every caller (a minimal singleflight).
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+type flightCall struct {
+	wg      sync.WaitGroup
+	waiters int // callers sharing this call's result; guarded by flightGroup.mu
+	out     []byte
+	ct      string
+	err     error
+}
+
+// do runs fn once for all concurrent callers using key. shared reports whether
+// the result came from another caller's execution. The returned slice is
+// shared between callers and must not be modified. If fn panics, the panic
+// propagates to the caller that ran it and the others receive an error.
+func (g *flightGroup) do(key string, fn func() ([]byte, string, error)) (out []byte, ct string, shared bool, err error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.out, c.ct, true, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			c.out, c.ct, c.err = nil, "", fmt.Errorf("transformation panicked: %v", r)
+		}
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+		if r != nil {
+			panic(r) // after releasing the waiters
+		}
+	}()
+	c.out, c.ct, c.err = fn()
+	return c.out, c.ct, false, c.err
+}
+
+// waiting returns the number of callers waiting on in-flight calls.
+func (g *flightGroup) waiting() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, c := range g.m {
+		n += c.waiters
+	}
+	return n
+}
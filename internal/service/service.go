@@ -1,9 +1,18 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"image"
 	"io"
+	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/nsarup/imgapi/internal/processing"
 	"github.com/nsarup/imgapi/internal/storage"
@@ -11,20 +20,288 @@ import (
 
 // Service wires storage and processing to deliver API behaviors.
 type Service struct {
-	store storage.Store
+	store     storage.Store
+	cache     Cache
+	strip     *processing.StripPolicy
+	extract   bool
+	watermark string // image ID that DefaultWatermark refers to
+	flight    flightGroup
+	stats     counters
 }
 
-func New(store storage.Store) *Service {
-	return &Service{store: store}
+// Stats reports processing counters since the service started.
+type Stats struct {
+	// Transforms is the number of decode/transform/encode runs.
+	Transforms int64 `json:"transforms"`
+	// Coalesced is the number of requests served by another request's
+	// identical in-flight transformation instead of running their own.
+	Coalesced int64 `json:"coalesced"`
+	// CacheHits is the number of requests served from the variant cache.
+	CacheHits int64 `json:"cache_hits"`
 }
 
-// SaveImage persists the provided bytes and returns an image ID.
-func (s *Service) SaveImage(data []byte, originalName string) (string, error) {
+type counters struct {
+	transforms atomic.Int64
+	coalesced  atomic.Int64
+	cacheHits  atomic.Int64
+}
+
+// Cache stores processed variants keyed by image ID and a canonical options key.
+type Cache interface {
+	Get(id, key string) (data []byte, contentType string, ok bool)
+	Put(id, key string, data []byte, contentType string) error
+	Invalidate(id string) error
+}
+
+// Option customizes a Service.
+type Option func(*Service)
+
+// WithCache serves processed variants from c and stores new ones in it.
+func WithCache(c Cache) Option {
+	return func(s *Service) { s.cache = c }
+}
+
+// WithMetadataStripping removes EXIF, XMP, IPTC and similar metadata from
+// uploads before they are stored, keeping what p asks for.
+func WithMetadataStripping(p processing.StripPolicy) Option {
+	return func(s *Service) { s.strip = &p }
+}
+
+// WithMetadataExtraction parses EXIF, IPTC and XMP metadata at upload time
+// and persists it with the image record, before any stripping. With stripping
+// also enabled, location and device fields are left out of the record.
+func WithMetadataExtraction() Option {
+	return func(s *Service) { s.extract = true }
+}
+
+// DefaultWatermark as a watermark ID selects the image configured with
+// WithDefaultWatermark.
+const DefaultWatermark = "default"
+
+// WithDefaultWatermark makes DefaultWatermark refer to the stored image id.
+func WithDefaultWatermark(id string) Option {
+	return func(s *Service) { s.watermark = id }
+}
+
+func New(store storage.Store, opts ...Option) *Service {
+	s := &Service{store: store}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// SaveImage streams r into storage together with a metadata record and returns
+// an image ID. Uploads larger than maxBytes (if > 0) fail with
+// processing.ErrTooLarge and leave nothing behind. With metadata stripping
+// enabled, the stored bytes (and their size and checksum) are the stripped ones.
+func (s *Service) SaveImage(r io.Reader, originalName string, maxBytes int64) (string, error) {
 	ext := filepath.Ext(originalName)
 	if len(ext) > 0 && ext[0] == '.' {
 		ext = ext[1:]
 	}
-	return s.store.Save(bytesReader(data), ext)
+	ur := processing.NewUploadReader(r, maxBytes)
+	upload := ur
+	var stripped func() []string
+	if s.strip != nil {
+		var body io.Reader
+		body, stripped = stripStream(ur, *s.strip)
+		// hash and sniff what is stored rather than what was sent
+		ur = processing.NewUploadReader(body, 0)
+	}
+	id, err := s.store.Save(ur, ext)
+	var removed []string
+	if stripped != nil {
+		removed = stripped()
+	}
+	if err != nil {
+		return "", err
+	}
+	// A content-addressed store returns the existing ID for duplicate content;
+	// keep the record of the first upload.
+	if _, err := s.store.LoadMeta(id); err == nil {
+		return id, nil
+	}
+	meta := storage.Metadata{
+		ID:          id,
+		ContentType: "application/octet-stream",
+		Size:        ur.Size(),
+		SHA256:      ur.Sum(),
+		UploadedAt:  time.Now().UTC(),
+		Stripped:    removed,
+	}
+	if originalName != "" {
+		meta.Filename = filepath.Base(originalName)
+	}
+	head := ur.Head()
+	f, cfg, err := processing.DecodeConfig(bytes.NewReader(head))
+	if err != nil && int64(len(head)) < ur.Size() {
+		// the header may lie beyond the sniffed head (TIFF writers often put
+		// the IFD after the pixel data), so read the stored original instead
+		if rsc, oerr := s.store.Open(id); oerr == nil {
+			f, cfg, err = processing.DecodeConfig(rsc)
+			rsc.Close()
+		}
+	}
+	if err == nil {
+		meta.Format = string(f)
+		meta.ContentType = processing.ContentType(f)
+		meta.Width, meta.Height = cfg.Width, cfg.Height
+	}
+	if s.extract {
+		b := upload.Head()
+		whole := int64(len(b)) == upload.Size()
+		if !whole && len(removed) == 0 {
+			// metadata may follow the pixel data (TIFF IFDs, WebP EXIF and
+			// XMP chunks, PNG text); nothing was stripped, so the stored
+			// original is the upload and can be parsed in full
+			if full, err := s.store.Load(id); err == nil {
+				b, whole = full, true
+			}
+		}
+		// a record from a partial file would hide fields EmbeddedMetadata
+		// could otherwise parse from the original, so keep none
+		if whole || processing.MetadataComplete(b) {
+			em := processing.ExtractMetadata(b)
+			if s.strip != nil {
+				// stripping is a privacy measure; don't republish what it removed
+				em = em.Redacted()
+			}
+			meta.EXIF, _ = json.Marshal(em)
+		}
+	}
+	if err := s.store.SaveMeta(id, meta); err != nil {
+		_ = s.store.Delete(id)
+		return "", err
+	}
+	return id, nil
+}
+
+// EmbeddedMetadata returns the EXIF, IPTC and XMP metadata of image id, as
+// recorded at upload time or else parsed from the stored original.
+func (s *Service) EmbeddedMetadata(id string) (processing.EmbeddedMetadata, error) {
+	var em processing.EmbeddedMetadata
+	if meta, err := s.store.LoadMeta(id); err == nil && len(meta.EXIF) > 0 {
+		if err := json.Unmarshal(meta.EXIF, &em); err == nil {
+			return em, nil
+		}
+	}
+	b, err := s.store.Load(id)
+	if err != nil {
+		return em, err
+	}
+	return processing.ExtractMetadata(b), nil
+}
+
+// stripStream returns a reader yielding r with metadata removed per p. The
+// returned func must be called once the reader is no longer used; it stops the
+// filter and reports the kinds of metadata removed.
+func stripStream(r io.Reader, p processing.StripPolicy) (io.Reader, func() []string) {
+	pr, pw := io.Pipe()
+	done := make(chan []string, 1)
+	go func() {
+		removed, err := processing.StripMetadata(pw, r, p)
+		pw.CloseWithError(err)
+		done <- removed
+	}()
+	return pr, func() []string {
+		pr.Close() // unblocks the filter if the store stopped reading early
+		return <-done
+	}
+}
+
+// SetFocalPoint stores the focal point of image id, which centres cover crops
+// that do not choose their own focal point or gravity. A nil p clears it.
+// It returns os.ErrNotExist if the image is unknown.
+func (s *Service) SetFocalPoint(id string, p *processing.FocalPoint) error {
+	if p != nil && !p.Valid() {
+		return fmt.Errorf("%w: focal point must be x,y between 0 and 1", processing.ErrInvalidOption)
+	}
+	meta, err := s.store.LoadMeta(id)
+	if errors.Is(err, os.ErrNotExist) {
+		// images stored before metadata records existed get one now
+		meta, err = s.describe(id)
+	}
+	if err != nil {
+		return err
+	}
+	meta.Focal = nil
+	if p != nil {
+		meta.Focal = &storage.FocalPoint{X: p.X, Y: p.Y, UpdatedAt: time.Now().UTC()}
+	}
+	return s.store.SaveMeta(id, meta)
+}
+
+// describe builds a metadata record for a stored original that has none.
+func (s *Service) describe(id string) (storage.Metadata, error) {
+	b, err := s.store.Load(id)
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+	sum := sha256.Sum256(b)
+	meta := storage.Metadata{
+		ID:          id,
+		ContentType: detectContentType(b),
+		Size:        int64(len(b)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+	if f, err := processing.DetectFormat(b); err == nil {
+		meta.Format = string(f)
+	}
+	meta.Width, meta.Height, _ = processing.Dimensions(b)
+	return meta, nil
+}
+
+// withFocalPoint fills in the stored focal point of id when opts crop to
+// cover without choosing a focal point or gravity themselves, and returns
+// when that focal point was set.
+func (s *Service) withFocalPoint(id string, opts processing.Options) (processing.Options, time.Time) {
+	if opts.Focal != nil || opts.Gravity != "" || !opts.CoverCrop() {
+		return opts, time.Time{}
+	}
+	meta, err := s.store.LoadMeta(id)
+	if err != nil || meta.Focal == nil {
+		return opts, time.Time{}
+	}
+	opts.Focal = &processing.FocalPoint{X: meta.Focal.X, Y: meta.Focal.Y}
+	return opts, meta.Focal.UpdatedAt
+}
+
+// withWatermark resolves the watermark in opts to a stored image and tags it
+// with that image's checksum, so replacing the watermark changes the cache key.
+// It also returns when the watermark was uploaded. Unknown watermarks are
+// invalid options rather than missing images.
+func (s *Service) withWatermark(opts processing.Options) (processing.Options, time.Time, error) {
+	if opts.Watermark == nil {
+		return opts, time.Time{}, nil
+	}
+	wm := *opts.Watermark
+	if wm.ID == DefaultWatermark {
+		if s.watermark == "" {
+			return opts, time.Time{}, fmt.Errorf("%w: no default watermark is configured", processing.ErrInvalidOption)
+		}
+		wm.ID = s.watermark
+	}
+	version, uploadedAt, err := s.sourceVersion(wm.ID)
+	if errors.Is(err, os.ErrNotExist) {
+		return opts, time.Time{}, fmt.Errorf("%w: watermark %s not found", processing.ErrInvalidOption, wm.ID)
+	}
+	if err != nil {
+		return opts, time.Time{}, err
+	}
+	wm.Version = version
+	opts.Watermark = &wm
+	return opts, uploadedAt, nil
+}
+
+// ImageMeta returns the metadata record stored for id, or one described
+// from the stored original for images that have no record.
+func (s *Service) ImageMeta(id string) (storage.Metadata, error) {
+	meta, err := s.store.LoadMeta(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.describe(id)
+	}
+	return meta, err
 }
 
 // GetImage returns the image bytes, optionally transcoded to target format.
@@ -62,43 +339,221 @@ func (s *Service) GetImage(id string, target string) ([]byte, string, error) {
 }
 
 // GetImageWithOptions returns the image bytes after applying processing options.
+// Processed variants are served from and added to the cache when configured,
+// and identical concurrent requests share a single transformation. The
+// returned slice may be shared and must not be modified.
 func (s *Service) GetImageWithOptions(id string, opts processing.Options) ([]byte, string, error) {
-	b, err := s.store.Load(id)
+	if opts.IsNoop() {
+		b, err := s.store.Load(id)
+		if err != nil {
+			return nil, "", err
+		}
+		return b, detectContentType(b), nil
+	}
+	opts, _ = s.withFocalPoint(id, opts)
+	opts, _, err := s.withWatermark(opts)
 	if err != nil {
 		return nil, "", err
 	}
-	if opts.IsNoop() {
-		// same behavior as GetImage with empty target
-		f, derr := processing.DetectFormat(b)
-		if derr != nil {
-			return b, "application/octet-stream", nil
+
+	key := opts.Key()
+	if s.cache != nil {
+		// Confirm the source still exists before trusting the cache, and tie the
+		// key to its checksum so a replaced source never hits stale variants.
+		source, _, err := s.sourceVersion(id)
+		if err != nil {
+			return nil, "", err
 		}
-		switch f {
-		case processing.FormatJPEG:
-			return b, "image/jpeg", nil
-		case processing.FormatPNG:
-			return b, "image/png", nil
-		default:
-			return b, "application/octet-stream", nil
+		key = source + "|" + key
+		if out, ct, ok := s.cache.Get(id, key); ok {
+			s.stats.cacheHits.Add(1)
+			return out, ct, nil
+		}
+	}
+	out, ct, shared, err := s.flight.do(id+"|"+key, func() ([]byte, string, error) {
+		b, err := s.store.Load(id)
+		if err != nil {
+			return nil, "", err
 		}
+		if wm := opts.Watermark; wm != nil {
+			wb, err := s.store.Load(wm.ID)
+			if err != nil {
+				return nil, "", err
+			}
+			if wm.Image, err = processing.DecodeWatermark(wb); err != nil {
+				return nil, "", fmt.Errorf("%w: watermark %s: %v", processing.ErrInvalidOption, wm.ID, err)
+			}
+		}
+		s.stats.transforms.Add(1)
+		out, ct, err := processing.Process(b, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		if s.cache != nil {
+			_ = s.cache.Put(id, key, out, ct)
+		}
+		return out, ct, nil
+	})
+	if shared {
+		s.stats.coalesced.Add(1)
 	}
-	out, ct, err := processing.Process(b, opts)
 	return out, ct, err
 }
 
-// bytesReader returns a new reader for the byte slice without escaping the data.
-func bytesReader(b []byte) *bytesReaderT { return &bytesReaderT{b: b} }
+// Original is a stored original opened for streaming.
+type Original struct {
+	io.ReadSeekCloser
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// OpenOriginal opens the stored original for streaming, so ranges and HEAD
+// can be served without loading the whole image. Type and dimensions come
+// from the metadata record when available.
+func (s *Service) OpenOriginal(id string) (*Original, error) {
+	rsc, err := s.store.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta, err := s.store.LoadMeta(id); err == nil && meta.ContentType != "" {
+		return &Original{ReadSeekCloser: rsc, ContentType: meta.ContentType, Width: meta.Width, Height: meta.Height}, nil
+	}
+	// no metadata record: sniff the header and rewind
+	head, err := io.ReadAll(io.LimitReader(rsc, 64<<10))
+	if err == nil {
+		_, err = rsc.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		rsc.Close()
+		return nil, err
+	}
+	o := &Original{ReadSeekCloser: rsc, ContentType: detectContentType(head)}
+	o.Width, o.Height, _ = processing.Dimensions(head)
+	return o, nil
+}
+
+// Stats returns a snapshot of the service counters.
+func (s *Service) Stats() Stats {
+	return Stats{
+		Transforms: s.stats.transforms.Load(),
+		Coalesced:  s.stats.coalesced.Load(),
+		CacheHits:  s.stats.cacheHits.Load(),
+	}
+}
 
-type bytesReaderT struct {
-	b []byte
-	i int
+// sourceVersion returns the checksum and upload time of the stored original.
+// Images stored before metadata records existed are hashed on the fly and
+// report a zero time. It fails with os.ErrNotExist if the image is gone.
+func (s *Service) sourceVersion(id string) (string, time.Time, error) {
+	meta, err := s.store.LoadMeta(id)
+	if err == nil && meta.SHA256 != "" {
+		return meta.SHA256, meta.UploadedAt, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", time.Time{}, err
+	}
+	b, err := s.store.Load(id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), meta.UploadedAt, nil
 }
 
-func (r *bytesReaderT) Read(p []byte) (int, error) {
-	if r.i >= len(r.b) {
-		return 0, io.EOF
+// Validators returns the strong ETag and last-modified time of the
+// representation opts produces for id, without processing the image.
+// Originals are tagged with their content hash and derivatives with a hash
+// of the source checksum and the canonical options, which include any stored
+// focal point the crop follows.
+func (s *Service) Validators(id string, opts processing.Options) (etag string, modTime time.Time, err error) {
+	source, modTime, err := s.sourceVersion(id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if opts.IsNoop() {
+		return `"` + source + `"`, modTime, nil
+	}
+	opts, focalAt := s.withFocalPoint(id, opts)
+	opts, watermarkAt, err := s.withWatermark(opts)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	for _, t := range []time.Time{focalAt, watermarkAt} {
+		if t.After(modTime) {
+			modTime = t
+		}
+	}
+	sum := sha256.Sum256([]byte(source + "|" + opts.Key()))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, modTime, nil
+}
+
+// DeleteImage removes the image and everything derived from it, including
+// cached variants. It returns os.ErrNotExist if the image is unknown.
+func (s *Service) DeleteImage(id string) error {
+	if err := s.store.Delete(id); err != nil {
+		return err
+	}
+	if s.cache != nil {
+		return s.cache.Invalidate(id)
+	}
+	return nil
+}
+
+// detectContentType returns the MIME type of an encoded image.
+func detectContentType(b []byte) string {
+	f, err := processing.DetectFormat(b)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return processing.ContentType(f)
+}
+
+// ImageInfo summarizes a stored image for listings.
+type ImageInfo struct {
+	ID         string
+	Size       int64
+	Format     string
+	Width      int
+	Height     int
+	UploadedAt time.Time
+}
+
+// ListImages returns a page of stored images starting after cursor, together
+// with the cursor for the following page ("" when there are no more).
+func (s *Service) ListImages(cursor string, limit int) ([]ImageInfo, string, error) {
+	entries, next, err := s.store.List(cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	out := make([]ImageInfo, 0, len(entries))
+	for _, e := range entries {
+		info := ImageInfo{ID: e.ID, Size: e.Size, UploadedAt: e.ModTime}
+		meta, err := s.store.LoadMeta(e.ID)
+		switch {
+		case err == nil:
+			info.Format = meta.Format
+			info.Width, info.Height = meta.Width, meta.Height
+			info.UploadedAt = meta.UploadedAt
+		case errors.Is(err, os.ErrNotExist):
+			// images stored before metadata records existed: inspect the bytes
+			b, err := s.store.Load(e.ID)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue // deleted since listing
+				}
+				return nil, "", err
+			}
+			if f, err := processing.DetectFormat(b); err == nil {
+				info.Format = string(f)
+			}
+			if cfg, _, err := image.DecodeConfig(bytes.NewReader(b)); err == nil {
+				info.Width, info.Height = cfg.Width, cfg.Height
+			}
+		default:
+			return nil, "", err
+		}
+		out = append(out, info)
 	}
-	n := copy(p, r.b[r.i:])
-	r.i += n
-	return n, nil
+	return out, next, nil
 }
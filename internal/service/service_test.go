@@ -0,0 +1,413 @@
+package service_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsarup/imgapi/internal/processing"
+	"github.com/nsarup/imgapi/internal/service"
+	"github.com/nsarup/imgapi/internal/storage"
+)
+
+// gatedStore blocks Load until released so concurrent requests overlap.
+type gatedStore struct {
+	storage.Store
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (g *gatedStore) Load(id string) ([]byte, error) {
+	g.once.Do(func() { close(g.entered) })
+	<-g.release
+	return g.Store.Load(id)
+}
+
+// waitForFlightWaiters blocks until n callers wait on an in-flight call.
+func waitForFlightWaiters(t *testing.T, svc *service.Service, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.FlightWaiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d callers joined the in-flight call", svc.FlightWaiters(), n)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestIdenticalTransformsAreCoalesced(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	id, err := service.New(fs).SaveImage(&buf, "x.png", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := &gatedStore{Store: fs, entered: make(chan struct{}), release: make(chan struct{})}
+	svc := service.New(gs)
+	opts := processing.Options{Width: 8, Target: processing.FormatJPEG}
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make([][]byte, n)
+	run := func(i int) {
+		defer wg.Done()
+		out, _, err := svc.GetImageWithOptions(id, opts)
+		if err != nil {
+			t.Errorf("get: %v", err)
+		}
+		results[i] = out
+	}
+	wg.Add(n)
+	go run(0)
+	<-gs.entered // the leader is now inside the transformation
+	for i := 1; i < n; i++ {
+		go run(i)
+	}
+	waitForFlightWaiters(t, svc, n-1)
+	close(gs.release)
+	wg.Wait()
+
+	st := svc.Stats()
+	if st.Transforms != 1 || st.Coalesced != n-1 {
+		t.Fatalf("stats = %+v, want 1 transform and %d coalesced", st, n-1)
+	}
+	for i := 1; i < n; i++ {
+		if !bytes.Equal(results[i], results[0]) {
+			t.Fatalf("result %d differs", i)
+		}
+	}
+}
+
+// panickyStore panics in the first Load once released, as a decoder might on
+// hostile input.
+type panickyStore struct {
+	gatedStore
+	panicked atomic.Bool
+}
+
+func (p *panickyStore) Load(id string) ([]byte, error) {
+	b, err := p.gatedStore.Load(id)
+	if p.panicked.CompareAndSwap(false, true) {
+		panic("corrupt input")
+	}
+	return b, err
+}
+
+func TestPanickingTransformReleasesWaiters(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	id, err := service.New(fs).SaveImage(&buf, "x.png", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := &panickyStore{gatedStore: gatedStore{Store: fs, entered: make(chan struct{}), release: make(chan struct{})}}
+	svc := service.New(ps)
+	opts := processing.Options{Width: 8, Target: processing.FormatJPEG}
+
+	leader := make(chan any)
+	go func() {
+		defer func() { leader <- recover() }()
+		_, _, _ = svc.GetImageWithOptions(id, opts)
+	}()
+	<-ps.entered
+	follower := make(chan error)
+	go func() {
+		_, _, err := svc.GetImageWithOptions(id, opts)
+		follower <- err
+	}()
+	waitForFlightWaiters(t, svc, 1)
+	close(ps.release)
+
+	if r := <-leader; r == nil {
+		t.Fatalf("leader did not panic")
+	}
+	if err := <-follower; err == nil {
+		t.Fatalf("follower got no error")
+	}
+	// the failed call is forgotten, so later requests run again
+	if _, _, err := svc.GetImageWithOptions(id, opts); err != nil {
+		t.Fatalf("after panic: %v", err)
+	}
+}
+
+func jpegSegment(marker byte, payload string) []byte {
+	n := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(n >> 8), byte(n)}, payload...)
+}
+
+func TestUploadStripsJPEGMetadata(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.New(fs, service.WithMetadataStripping(processing.StripPolicy{KeepICC: true, KeepOrientation: true}))
+
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := "Exif\x00\x00II*\x00\x08\x00\x00\x00\x02\x00" +
+		"\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00" + // Orientation 6
+		"\x10\x01\x02\x00\x06\x00\x00\x00\x26\x00\x00\x00" + // Model at 38
+		"\x00\x00\x00\x00SECRET"
+	var in bytes.Buffer
+	in.Write(enc.Bytes()[:2])
+	in.Write(jpegSegment(0xE1, exif))
+	in.Write(jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS</x:xmpmeta>"))
+	in.Write(jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile"))
+	in.Write(jpegSegment(0xFE, "shot by SECRET"))
+	in.Write(enc.Bytes()[2:])
+
+	id, err := svc.SaveImage(&in, "phone.jpg", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := fs.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("SECRET")) || bytes.Contains(stored, []byte("GPS")) {
+		t.Fatalf("metadata survived stripping")
+	}
+	if !bytes.Contains(stored, []byte("ICC_PROFILE")) {
+		t.Fatalf("ICC profile was not kept")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+		t.Fatalf("stripped JPEG does not decode: %v", err)
+	}
+	// orientation is still applied when processing
+	out, _, err := svc.GetImageWithOptions(id, processing.Options{Target: processing.FormatPNG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h, _ := processing.Dimensions(out); w != 4 || h != 8 {
+		t.Fatalf("oriented size = %dx%d, want 4x8", w, h)
+	}
+
+	meta, err := svc.ImageMeta(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"exif", "xmp", "comment"}; !reflect.DeepEqual(meta.Stripped, want) {
+		t.Fatalf("stripped = %v, want %v", meta.Stripped, want)
+	}
+	if meta.Size != int64(len(stored)) || meta.Width != 8 {
+		t.Fatalf("meta describes the upload, not the stored bytes: %+v", meta)
+	}
+}
+
+func TestUploadStripsPNGMetadata(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.New(fs, service.WithMetadataStripping(processing.StripPolicy{}))
+
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(typ, data string) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		b = append(b, typ+data...)
+		return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+	}
+	// insert ancillary chunks after IHDR (8-byte signature + 25-byte chunk)
+	var in bytes.Buffer
+	in.Write(enc.Bytes()[:33])
+	in.Write(chunk("iCCP", "sRGB\x00\x00profile"))
+	in.Write(chunk("tEXt", "Author\x00SECRET"))
+	in.Write(chunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))
+	in.Write(enc.Bytes()[33:])
+
+	id, err := svc.SaveImage(&in, "x.png", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := fs.Load(id)
+	if bytes.Contains(stored, []byte("SECRET")) || bytes.Contains(stored, []byte("iCCP")) {
+		t.Fatalf("metadata survived stripping")
+	}
+	if !bytes.Equal(stored, enc.Bytes()) {
+		t.Fatalf("stripped PNG differs from the original encoding")
+	}
+	meta, _ := svc.ImageMeta(id)
+	if want := []string{"icc", "text", "xmp"}; !reflect.DeepEqual(meta.Stripped, want) {
+		t.Fatalf("stripped = %v, want %v", meta.Stripped, want)
+	}
+}
+
+func TestStripDropsTruncatedPNGChunk(t *testing.T) {
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	// a tEXt chunk claiming almost 2 GiB but holding a few bytes
+	var in bytes.Buffer
+	in.Write(enc.Bytes()[:33])
+	in.Write(binary.BigEndian.AppendUint32(nil, 0x7FFFFFF0))
+	in.WriteString("tEXtAuthor\x00SECRET")
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var out bytes.Buffer
+	removed, err := processing.StripMetadata(&out, &in, processing.StripPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16<<20 {
+		t.Fatalf("allocated %d bytes for a %d byte input", n, 33+8+len("Author\x00SECRET"))
+	}
+	if !bytes.Equal(out.Bytes(), enc.Bytes()[:33]) {
+		t.Fatalf("output = %q, want the chunks before the truncated one", out.Bytes())
+	}
+	if want := []string{"text"}; !reflect.DeepEqual(removed, want) {
+		t.Fatalf("removed = %v, want %v", removed, want)
+	}
+}
+
+func TestGIFWithLargeScreenAndTinyFrames(t *testing.T) {
+	// a 2000x2000 screen with ten 1x1 frames: a few hundred bytes that
+	// coalesce to 16 MB per frame
+	anim := &gif.GIF{Config: image.Config{Width: 2000, Height: 2000}}
+	for i := range 10 {
+		f := image.NewPaletted(image.Rect(i, i, i+1, i+1), color.Palette{color.Black, color.White})
+		anim.Image = append(anim.Image, f)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := processing.Process(buf.Bytes(), processing.Options{Width: 10}); err == nil {
+		t.Fatal("animated output of an oversized GIF succeeded")
+	}
+	for _, opts := range []processing.Options{
+		{Width: 10, Frame: 3},
+		{Width: 10, Target: processing.FormatPNG},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, _, err := processing.Process(buf.Bytes(), opts); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+			t.Fatalf("%+v: allocated %d bytes for a %d byte GIF", opts, n, buf.Len())
+		}
+	}
+}
+
+func TestImageMetaWithoutRecord(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 6, 4))); err != nil {
+		t.Fatal(err)
+	}
+	// stored directly, as images were before metadata records existed
+	id, err := fs.Save(bytes.NewReader(buf.Bytes()), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.New(fs)
+	meta, err := svc.ImageMeta(id)
+	if err != nil {
+		t.Fatalf("ImageMeta: %v", err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if meta.ID != id || meta.Format != "png" || meta.ContentType != "image/png" || meta.Width != 6 || meta.Height != 4 ||
+		meta.Size != int64(buf.Len()) || meta.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("meta = %+v", meta)
+	}
+	if _, err := svc.ImageMeta("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing image: %v", err)
+	}
+}
+
+func TestUploadStrippingKeepsSizeLimit(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.New(fs, service.WithMetadataStripping(processing.StripPolicy{}))
+	big := append([]byte{0xFF, 0xD8}, make([]byte, 1<<20)...)
+	if _, err := svc.SaveImage(bytes.NewReader(big), "x.jpg", 1024); !errors.Is(err, processing.ErrTooLarge) {
+		t.Fatalf("err = %v, want ErrTooLarge", err)
+	}
+	if entries, _, _ := fs.List("", 10); len(entries) != 0 {
+		t.Fatalf("left %d entries behind", len(entries))
+	}
+}
+
+func TestDefaultWatermark(t *testing.T) {
+	fs, err := storage.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	save := func(w, h int) string {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		id, err := service.New(fs).SaveImage(&buf, "x.png", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	id, mark := save(32, 32), save(8, 8)
+	withMark := func(wm string) processing.Options {
+		return processing.Options{Watermark: &processing.Watermark{ID: wm, Scale: 0.5, Opacity: 1}}
+	}
+
+	if _, _, err := service.New(fs).GetImageWithOptions(id, withMark(service.DefaultWatermark)); !errors.Is(err, processing.ErrInvalidOption) {
+		t.Fatalf("unconfigured default: err = %v, want ErrInvalidOption", err)
+	}
+	svc := service.New(fs, service.WithDefaultWatermark(mark))
+	if _, _, err := svc.GetImageWithOptions(id, withMark(service.DefaultWatermark)); err != nil {
+		t.Fatal(err)
+	}
+	byDefault, _, err := svc.Validators(id, withMark(service.DefaultWatermark))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID, _, _ := svc.Validators(id, withMark(mark))
+	if byDefault != byID {
+		t.Fatalf("ETag via default %s, via ID %s", byDefault, byID)
+	}
+}
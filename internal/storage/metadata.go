@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Metadata is the per-image record persisted alongside the image bytes.
+type Metadata struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Format      string    `json:"format,omitempty"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	// Stripped lists the kinds of metadata removed on upload, e.g. "exif".
+	Stripped []string `json:"stripped,omitempty"`
+	// EXIF holds the normalized EXIF/IPTC/XMP fields extracted at upload time,
+	// if extraction was enabled.
+	EXIF json.RawMessage `json:"exif,omitempty"`
+	// Focal is the editor-chosen subject of the image, if any.
+	Focal *FocalPoint `json:"focal,omitempty"`
+}
+
+// FocalPoint is a position normalized to the image size: (0,0) is the
+// top-left corner and (1,1) the bottom-right.
+type FocalPoint struct {
+	X         float64   `json:"x"`
+	Y         float64   `json:"y"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// metaSuffix names the JSON sidecar next to an original. Originals are always
+// stored as id.<alnum ext>, so the double extension can never collide.
+const metaSuffix = ".meta.json"
+
+func isSidecar(name string) bool { return strings.HasSuffix(name, metaSuffix) }
+
+// metaPath returns the sidecar path for id in the store's layout.
+func (s *FileStore) metaPath(id string) string {
+	if s.sharded {
+		return s.shardedPath(id) + metaSuffix
+	}
+	return filepath.Join(s.baseDir, id+metaSuffix)
+}
+
+// SaveMeta writes the metadata sidecar for id.
+func (s *FileStore) SaveMeta(id string, meta Metadata) error {
+	if !validID(id) {
+		return os.ErrNotExist
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(s.baseDir, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	return commitTemp(tmp, s.metaPath(id))
+}
+
+// LoadMeta reads the metadata sidecar for id.
+func (s *FileStore) LoadMeta(id string) (Metadata, error) {
+	if !validID(id) {
+		return Metadata{}, os.ErrNotExist
+	}
+	b, err := os.ReadFile(s.metaPath(id))
+	if err != nil {
+		return Metadata{}, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return Metadata{}, err
+	}
+	return meta, nil
+}
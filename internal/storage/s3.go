@@ -0,0 +1,495 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3Store.
+type S3Config struct {
+	// Endpoint is the base URL of the S3 service, e.g. "https://s3.us-east-1.amazonaws.com"
+	// or "http://minio:9000". Requests use path-style addressing.
+	Endpoint string
+	// Bucket is the bucket holding the images; it must already exist.
+	Bucket string
+	// Region is used for request signing; MinIO and Ceph accept "us-east-1".
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every object key, e.g. "imgapi/".
+	Prefix string
+	// ContentAddressed makes Save use the hex SHA-256 of the content as the
+	// image ID, so identical uploads share a single object.
+	ContentAddressed bool
+	// Client is the HTTP client used for requests; nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// S3Store stores images in an S3-compatible object store. Originals live under
+// {prefix}images/{id} and metadata records under {prefix}meta/{id}.json.
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3Store creates a new S3Store for the bucket described by cfg.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket required")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint must be an absolute URL: %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Store{cfg: cfg, endpoint: u, client: client, now: time.Now}, nil
+}
+
+// Save uploads the content under a new ID. The stream is spooled to a temporary
+// file first because S3 needs the length and payload hash before the body.
+func (s *S3Store) Save(reader io.Reader, hintedExt string) (string, error) {
+	tmp, err := os.CreateTemp("", "imgapi-s3-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), reader)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	id := generateID()
+	if s.cfg.ContentAddressed {
+		id = sum
+		if err := s.head(s.imageKey(id)); err == nil {
+			return id, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	hdr := http.Header{"Content-Type": {"application/octet-stream"}}
+	if hintedExt != "" {
+		hdr.Set("X-Amz-Meta-Ext", sanitizeExt(hintedExt))
+	}
+	resp, err := s.do(http.MethodPut, s.imageKey(id), nil, hdr, tmp, n, sum)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return id, nil
+}
+
+// Load downloads the content stored for id.
+func (s *S3Store) Load(id string) ([]byte, error) {
+	if !validID(id) {
+		return nil, os.ErrNotExist
+	}
+	return s.get(s.imageKey(id))
+}
+
+// Open returns a seekable reader over the object for id. Reads are served
+// by ranged GETs starting at the current offset, so seeking is free and only
+// the bytes actually read are transferred.
+func (s *S3Store) Open(id string) (io.ReadSeekCloser, error) {
+	if !validID(id) {
+		return nil, os.ErrNotExist
+	}
+	key := s.imageKey(id)
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("s3 HEAD %s: missing Content-Length", key)
+	}
+	return &s3Object{s: s, key: key, size: resp.ContentLength}, nil
+}
+
+// s3Object reads an object lazily with ranged GETs.
+type s3Object struct {
+	s    *S3Store
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser // open range response starting at off, if any
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		hdr := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.off)}}
+		resp, err := o.s.do(http.MethodGet, o.key, nil, hdr, nil, 0, emptySHA256)
+		if err != nil {
+			return 0, err
+		}
+		// a server that ignores Range sends the whole object with 200; that
+		// is only usable when reading from the start
+		if !(resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", o.off))) &&
+			!(resp.StatusCode == http.StatusOK && o.off == 0) {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3 GET %s: range from byte %d not honoured: %s, Content-Range %q",
+				o.key, o.off, resp.Status, resp.Header.Get("Content-Range"))
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.off + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if abs != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.off = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+// PathFor returns the object URL for id.
+func (s *S3Store) PathFor(id string) (string, error) {
+	if !validID(id) {
+		return "", os.ErrNotExist
+	}
+	if err := s.head(s.imageKey(id)); err != nil {
+		return "", err
+	}
+	return s.objectURL(s.imageKey(id), nil).String(), nil
+}
+
+// Delete removes the image and its metadata record.
+func (s *S3Store) Delete(id string) error {
+	if !validID(id) {
+		return os.ErrNotExist
+	}
+	// S3 DELETE succeeds for missing keys, so check existence first.
+	if err := s.head(s.imageKey(id)); err != nil {
+		return err
+	}
+	for _, key := range []string{s.metaKey(id), s.imageKey(id)} {
+		resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0, emptySHA256)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	return nil
+}
+
+// List enumerates stored images via ListObjectsV2.
+func (s *S3Store) List(cursor string, limit int) ([]Entry, string, error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+	prefix := s.cfg.Prefix + "images/"
+	q := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(limit)},
+	}
+	if cursor != "" {
+		q.Set("start-after", prefix+cursor)
+	}
+	resp, err := s.do(http.MethodGet, "", q, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var res listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, "", fmt.Errorf("s3 list: %w", err)
+	}
+	out := make([]Entry, 0, len(res.Contents))
+	for _, c := range res.Contents {
+		id := strings.TrimPrefix(c.Key, prefix)
+		if !validID(id) {
+			continue
+		}
+		out = append(out, Entry{ID: id, Size: c.Size, ModTime: c.LastModified})
+	}
+	next := ""
+	if res.IsTruncated && len(out) > 0 {
+		next = out[len(out)-1].ID
+	}
+	return out, next, nil
+}
+
+// SaveMeta uploads the metadata record for id.
+func (s *S3Store) SaveMeta(id string, meta Metadata) error {
+	if !validID(id) {
+		return os.ErrNotExist
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	hdr := http.Header{"Content-Type": {"application/json"}}
+	resp, err := s.do(http.MethodPut, s.metaKey(id), nil, hdr, bytes.NewReader(b), int64(len(b)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// LoadMeta downloads the metadata record for id.
+func (s *S3Store) LoadMeta(id string) (Metadata, error) {
+	if !validID(id) {
+		return Metadata{}, os.ErrNotExist
+	}
+	b, err := s.get(s.metaKey(id))
+	if err != nil {
+		return Metadata{}, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return Metadata{}, err
+	}
+	return meta, nil
+}
+
+func (s *S3Store) imageKey(id string) string { return s.cfg.Prefix + "images/" + id }
+func (s *S3Store) metaKey(id string) string  { return s.cfg.Prefix + "meta/" + id + ".json" }
+
+func (s *S3Store) get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3Store) head(key string) error {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectURL builds the path-style URL for key ("" addresses the bucket).
+func (s *S3Store) objectURL(key string, q url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = canonicalQuery(q)
+	return &u
+}
+
+// do sends a signed request and returns the response for 2xx statuses.
+// 404 responses are reported as os.ErrNotExist.
+func (s *S3Store) do(method, key string, q url.Values, hdr http.Header, body io.Reader, length int64, payloadHash string) (*http.Response, error) {
+	u := s.objectURL(key, q)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	signV4(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", payloadHash, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, os.ErrNotExist)
+	}
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if e.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: unexpected status %s", method, key, resp.Status)
+}
+
+type listBucketResult struct {
+	IsTruncated bool `xml:"IsTruncated"`
+	Contents    []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds AWS Signature Version 4 headers to req. It signs the host,
+// Content-Type, Range and all x-amz-* headers.
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "range" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// canonicalURI encodes each path segment per SigV4 rules (no double encoding for S3).
+func canonicalURI(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		segs[i] = uriEncode(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+// canonicalQuery renders q sorted by key with RFC 3986 encoding.
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except RFC 3986 unreserved characters.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithShardedLayout stores each image at {baseDir}/ab/cd/{id} (ab and cd being
+// the first four characters of the ID) so directories stay small and lookups
+// are a single stat instead of a glob. Existing flat data directories must be
+// converted with Reshard first.
+func WithShardedLayout() FileStoreOption {
+	return func(s *FileStore) { s.sharded = true }
+}
+
+// shardDepth is the number of two-character directory levels.
+const shardDepth = 2
+
+// shardedPath returns the deterministic path of the original for id.
+func (s *FileStore) shardedPath(id string) string {
+	return filepath.Join(s.baseDir, shardDir(id), id)
+}
+
+// shardDir returns the relative shard directory for id, e.g. "ab/cd".
+// IDs too short to shard are kept in "_".
+func shardDir(id string) string {
+	if len(id) < 2*shardDepth {
+		return "_"
+	}
+	parts := make([]string, shardDepth)
+	for i := range parts {
+		parts[i] = id[2*i : 2*i+2]
+	}
+	return filepath.Join(parts...)
+}
+
+func (s *FileStore) deleteSharded(id string) error {
+	if err := os.Remove(s.shardedPath(id)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.metaPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// errPageFull stops the shard walk once a page is complete.
+var errPageFull = errors.New("page full")
+
+// listSharded walks shard directories in lexical order. Since each shard is an
+// ID prefix this yields IDs in ascending order, and shards entirely before the
+// cursor are skipped without being read.
+func (s *FileStore) listSharded(cursor string, limit int) ([]Entry, string, error) {
+	var out []Entry
+	next := ""
+
+	var walk func(dir string, depth int, prefix string) error
+	walk = func(dir string, depth int, prefix string) error {
+		dirents, err := os.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // removed concurrently
+			}
+			return err
+		}
+		for _, de := range dirents {
+			name := de.Name()
+			if depth < shardDepth {
+				if !de.IsDir() || len(name) != 2 {
+					continue
+				}
+				// skip shards whose prefix sorts before the cursor's
+				if p := prefix + name; p < cursor[:min(len(p), len(cursor))] {
+					continue
+				}
+				if err := walk(filepath.Join(dir, name), depth+1, prefix+name); err != nil {
+					return err
+				}
+				continue
+			}
+			if de.IsDir() || strings.IndexByte(name, '.') >= 0 || name <= cursor || !validID(name) {
+				continue
+			}
+			if len(out) == limit {
+				next = out[len(out)-1].ID
+				return errPageFull
+			}
+			info, err := de.Info()
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			out = append(out, Entry{ID: name, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	}
+	if err := walk(s.baseDir, 0, ""); err != nil && !errors.Is(err, errPageFull) {
+		return nil, "", err
+	}
+	return out, next, nil
+}
+
+// checkNoFlatFiles refuses to open a flat data directory in sharded mode,
+// which would otherwise make every existing image unreachable.
+func checkNoFlatFiles(baseDir string) error {
+	dirents, err := os.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirents {
+		if !de.IsDir() && !strings.HasPrefix(de.Name(), ".") {
+			return fmt.Errorf("%s contains flat-layout files (e.g. %s); run imgapi-reshard first", baseDir, de.Name())
+		}
+	}
+	return nil
+}
+
+// Reshard moves every image and metadata sidecar stored in the flat layout of
+// baseDir into the sharded layout used by WithShardedLayout. It is safe to run
+// again after an interruption. It returns the number of images moved.
+func Reshard(baseDir string) (int, error) {
+	if err := removeTempFiles(baseDir); err != nil {
+		return 0, err
+	}
+	dirents, err := os.ReadDir(baseDir)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, de := range dirents {
+		name := de.Name()
+		if de.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot <= 0 || !validID(name[:dot]) {
+			continue
+		}
+		id := name[:dot]
+		dst := filepath.Join(baseDir, shardDir(id), id)
+		if isSidecar(name) {
+			dst += metaSuffix
+		}
+		if _, err := os.Stat(dst); err == nil {
+			return moved, fmt.Errorf("reshard %s: %s already exists", name, dst)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return moved, err
+		}
+		if err := commitTemp(filepath.Join(baseDir, name), dst); err != nil {
+			return moved, err
+		}
+		if !isSidecar(name) {
+			moved++
+		}
+	}
+	return moved, nil
+}
@@ -2,80 +2,313 @@ package storage
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Store defines operations for persisting and retrieving image bytes by ID.
 type Store interface {
 	Save(reader io.Reader, hintedExt string) (id string, err error)
 	Load(id string) (bytes []byte, err error)
+	// Open returns a seekable reader over the stored bytes for id, so callers
+	// can serve ranges without loading the whole image.
+	Open(id string) (io.ReadSeekCloser, error)
 	PathFor(id string) (string, error)
+	// Delete removes the image and every artifact stored for id.
+	// It returns os.ErrNotExist if nothing is stored under id.
+	Delete(id string) error
+	// List returns up to limit entries with IDs strictly greater than cursor,
+	// in ascending ID order, and the cursor for the next page ("" when done).
+	List(cursor string, limit int) (entries []Entry, next string, err error)
+	// SaveMeta stores the metadata record for id, replacing any previous one.
+	SaveMeta(id string, meta Metadata) error
+	// LoadMeta returns the metadata record for id, or os.ErrNotExist.
+	LoadMeta(id string) (Metadata, error)
+}
+
+// Entry describes a stored image as reported by List.
+type Entry struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
 }
 
 // FileStore stores image files on the local filesystem.
 type FileStore struct {
-	baseDir string
+	baseDir          string
+	contentAddressed bool
+	sharded          bool
+}
+
+// FileStoreOption customizes a FileStore.
+type FileStoreOption func(*FileStore)
+
+// WithContentAddressing makes Save use the hex SHA-256 of the content as the
+// image ID, so identical uploads share a single file.
+func WithContentAddressing() FileStoreOption {
+	return func(s *FileStore) { s.contentAddressed = true }
 }
 
-// NewFileStore creates a new FileStore rooted at baseDir.
-func NewFileStore(baseDir string) (*FileStore, error) {
+// NewFileStore creates a new FileStore rooted at baseDir. Temporary files left
+// behind by writes interrupted by a crash are removed; a data directory must
+// therefore be owned by a single process.
+func NewFileStore(baseDir string, opts ...FileStoreOption) (*FileStore, error) {
 	if baseDir == "" {
 		return nil, errors.New("baseDir required")
 	}
 	if err := os.MkdirAll(baseDir, 0o755); err != nil {
 		return nil, err
 	}
-	return &FileStore{baseDir: baseDir}, nil
+	s := &FileStore{baseDir: baseDir}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := removeTempFiles(baseDir); err != nil {
+		return nil, err
+	}
+	if s.sharded {
+		if err := checkNoFlatFiles(baseDir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 // Save writes the content to a new uniquely named file and returns its ID.
+// In content-addressed mode the ID is the SHA-256 of the content and saving
+// bytes that are already stored returns the existing ID without a second copy.
+// The file only appears under its final name once fully written and synced.
 func (s *FileStore) Save(reader io.Reader, hintedExt string) (string, error) {
-	id := generateID()
-	// store original as .bin; we keep extension information separate via processing
-	filename := id + ".bin"
-	if hintedExt != "" {
-		// purely cosmetic; retrieval is by id, processing detects type
-		filename = id + "." + sanitizeExt(hintedExt)
-	}
-	path := filepath.Join(s.baseDir, filename)
-	f, err := os.Create(path)
+	h := sha256.New()
+	if s.contentAddressed {
+		reader = io.TeeReader(reader, h)
+	}
+	tmp, err := writeTemp(s.baseDir, reader)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-	if _, err := io.Copy(f, reader); err != nil {
+	defer os.Remove(tmp) // no-op once renamed
+
+	id := generateID()
+	if s.contentAddressed {
+		id = hex.EncodeToString(h.Sum(nil))
+		if _, err := s.PathFor(id); err == nil {
+			return id, nil
+		}
+	}
+	path := filepath.Join(s.baseDir, originalName(id, hintedExt))
+	if s.sharded {
+		path = s.shardedPath(id)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+	}
+	if err := commitTemp(tmp, path); err != nil {
 		return "", err
 	}
 	return id, nil
 }
 
+// tempPrefix marks in-progress writes; such files are never served and are
+// swept on startup.
+const tempPrefix = ".tmp-"
+
+// writeTemp copies r into a new temporary file in dir and fsyncs it. The
+// caller must commit or remove the returned path; on error nothing is left.
+func writeTemp(dir string, r io.Reader) (string, error) {
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// commitTemp atomically moves a synced temporary file to path and syncs the
+// directory so the rename survives a crash.
+func commitTemp(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeTempFiles deletes orphaned temporary files in dir.
+func removeTempFiles(dir string) error {
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirents {
+		if !de.IsDir() && strings.HasPrefix(de.Name(), tempPrefix) {
+			if err := os.Remove(filepath.Join(dir, de.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// originalName returns the file name for an original. The extension is purely
+// cosmetic; retrieval is by id and processing detects the type.
+func originalName(id, hintedExt string) string {
+	if hintedExt == "" {
+		return id + ".bin"
+	}
+	return id + "." + sanitizeExt(hintedExt)
+}
+
 // Load reads the content for a given id by locating a file with known patterns.
 func (s *FileStore) Load(id string) ([]byte, error) {
-	// try known patterns
-	candidates, err := filepath.Glob(filepath.Join(s.baseDir, id+".*"))
+	p, err := s.PathFor(id)
 	if err != nil {
 		return nil, err
 	}
-	if len(candidates) == 0 {
-		return nil, os.ErrNotExist
+	return os.ReadFile(p)
+}
+
+// Open opens the stored file for id.
+func (s *FileStore) Open(id string) (io.ReadSeekCloser, error) {
+	p, err := s.PathFor(id)
+	if err != nil {
+		return nil, err
 	}
-	return os.ReadFile(candidates[0])
+	return os.Open(p)
 }
 
 // PathFor returns a path to the stored file for id.
 func (s *FileStore) PathFor(id string) (string, error) {
+	if !validID(id) {
+		return "", os.ErrNotExist
+	}
+	if s.sharded {
+		p := s.shardedPath(id)
+		if _, err := os.Stat(p); err != nil {
+			return "", err
+		}
+		return p, nil
+	}
 	candidates, err := filepath.Glob(filepath.Join(s.baseDir, id+".*"))
 	if err != nil {
 		return "", err
 	}
+	for _, c := range candidates {
+		if !isSidecar(c) {
+			return c, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// Delete removes every file stored under id.
+func (s *FileStore) Delete(id string) error {
+	if !validID(id) {
+		return os.ErrNotExist
+	}
+	if s.sharded {
+		return s.deleteSharded(id)
+	}
+	candidates, err := filepath.Glob(filepath.Join(s.baseDir, id+".*"))
+	if err != nil {
+		return err
+	}
 	if len(candidates) == 0 {
-		return "", os.ErrNotExist
+		return os.ErrNotExist
+	}
+	for _, c := range candidates {
+		if err := os.Remove(c); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List enumerates stored images in ascending ID order.
+func (s *FileStore) List(cursor string, limit int) ([]Entry, string, error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+	if s.sharded {
+		return s.listSharded(cursor, limit)
+	}
+	dirents, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return nil, "", err
+	}
+	byID := make(map[string]os.DirEntry)
+	for _, de := range dirents {
+		if de.IsDir() {
+			continue
+		}
+		name := de.Name()
+		dot := strings.IndexByte(name, '.')
+		if dot <= 0 || isSidecar(name) {
+			continue
+		}
+		id := name[:dot]
+		if id <= cursor || !validID(id) {
+			continue
+		}
+		if _, seen := byID[id]; !seen {
+			byID[id] = de
+		}
+	}
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	out := make([]Entry, 0, min(limit, len(ids)))
+	for _, id := range ids {
+		if len(out) == limit {
+			return out, out[len(out)-1].ID, nil
+		}
+		info, err := byID[id].Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // removed concurrently
+			}
+			return nil, "", err
+		}
+		out = append(out, Entry{ID: id, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return out, "", nil
+}
+
+// validID reports whether id is safe to use in file names and glob patterns.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_') {
+			return false
+		}
 	}
-	return candidates[0], nil
+	return true
 }
 
 func sanitizeExt(ext string) string {
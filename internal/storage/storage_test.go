@@ -0,0 +1,166 @@
+package storage_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nsarup/imgapi/internal/storage"
+)
+
+func TestFileStoreContentAddressedDedup(t *testing.T) {
+	dir := t.TempDir()
+	s, err := storage.NewFileStore(dir, storage.WithContentAddressing())
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	id1, err := s.Save(strings.NewReader("same bytes"), "png")
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	id2, err := s.Save(strings.NewReader("same bytes"), "jpg")
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	sum := sha256.Sum256([]byte("same bytes"))
+	if id1 != hex.EncodeToString(sum[:]) || id2 != id1 {
+		t.Fatalf("ids = %s, %s; want content hash", id1, id2)
+	}
+	entries, _, err := s.List("", 10)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("list = %v, %v; want one entry", entries, err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("want a single file on disk, got %d", len(files))
+	}
+
+	if err := s.Delete(id1); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Load(id1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("load after delete: %v", err)
+	}
+}
+
+func TestFileStoreRemovesOrphanedTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	orphan := filepath.Join(dir, ".tmp-123456")
+	if err := os.WriteFile(orphan, []byte("truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := storage.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("orphaned temp file survived: %v", err)
+	}
+
+	id, err := s.Save(strings.NewReader("payload"), "png")
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != id+".png" {
+		t.Fatalf("unexpected files after save: %v", files)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestFileStoreFailedSaveLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	s, err := storage.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	if _, err := s.Save(io.MultiReader(strings.NewReader("partial"), failingReader{}), "png"); err == nil {
+		t.Fatal("expected save error")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("failed save left files: %v", files)
+	}
+}
+
+func TestReshardAndShardedStore(t *testing.T) {
+	dir := t.TempDir()
+	flat, err := storage.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := flat.Save(strings.NewReader("image "+string(rune('a'+i))), "png")
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := flat.SaveMeta(id, storage.Metadata{ID: id, Filename: id + ".png"}); err != nil {
+			t.Fatalf("save meta: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if _, err := storage.NewFileStore(dir, storage.WithShardedLayout()); err == nil {
+		t.Fatal("sharded store opened a flat directory")
+	}
+	n, err := storage.Reshard(dir)
+	if err != nil || n != len(ids) {
+		t.Fatalf("reshard = %d, %v", n, err)
+	}
+	s, err := storage.NewFileStore(dir, storage.WithShardedLayout())
+	if err != nil {
+		t.Fatalf("NewFileStore sharded: %v", err)
+	}
+	for _, id := range ids {
+		p, err := s.PathFor(id)
+		if err != nil {
+			t.Fatalf("path for %s: %v", id, err)
+		}
+		if want := filepath.Join(dir, id[:2], id[2:4], id); p != want {
+			t.Fatalf("path = %s, want %s", p, want)
+		}
+		if meta, err := s.LoadMeta(id); err != nil || meta.Filename != id+".png" {
+			t.Fatalf("meta for %s = %+v, %v", id, meta, err)
+		}
+	}
+
+	newID, err := s.Save(strings.NewReader("fresh"), "jpg")
+	if err != nil {
+		t.Fatalf("save sharded: %v", err)
+	}
+	ids = append(ids, newID)
+	sort.Strings(ids)
+	var listed []string
+	cursor := ""
+	for {
+		entries, next, err := s.List(cursor, 2)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		for _, e := range entries {
+			listed = append(listed, e.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if strings.Join(listed, ",") != strings.Join(ids, ",") {
+		t.Fatalf("listed %v, want %v", listed, ids)
+	}
+
+	if err := s.Delete(newID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Load(newID); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("load after delete: %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package api
 
+import "time"
+
 // UploadResponse is returned after a successful upload.
 type UploadResponse struct {
 	ID string `json:"id"`
@@ -9,3 +11,69 @@ type UploadResponse struct {
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
+
+// ImageInfo describes a stored image in listings.
+type ImageInfo struct {
+	ID         string    `json:"id"`
+	Size       int64     `json:"size"`
+	Format     string    `json:"format,omitempty"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// ListResponse is a page of images returned by GET /images.
+type ListResponse struct {
+	Images     []ImageInfo `json:"images"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// ImageMetadata is the metadata record returned by GET /images/{id}/meta.
+type ImageMetadata struct {
+	ID          string      `json:"id"`
+	Filename    string      `json:"filename,omitempty"`
+	ContentType string      `json:"content_type"`
+	Format      string      `json:"format,omitempty"`
+	Size        int64       `json:"size"`
+	Width       int         `json:"width,omitempty"`
+	Height      int         `json:"height,omitempty"`
+	SHA256      string      `json:"sha256,omitempty"`
+	UploadedAt  time.Time   `json:"uploaded_at"`
+	Stripped    []string    `json:"stripped,omitempty"`
+	Focal       *FocalPoint `json:"focal,omitempty"`
+}
+
+// FocalPoint is the body of PUT /images/{id}/focal: a position normalized to
+// the image size, from (0,0) at the top-left to (1,1) at the bottom-right.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// EmbeddedMetadata is the normalized EXIF/IPTC/XMP metadata returned by
+// GET /images/{id}/exif. Fields absent from the image are omitted.
+type EmbeddedMetadata struct {
+	CaptureTime  string   `json:"capture_time,omitempty"`
+	Make         string   `json:"make,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	LensModel    string   `json:"lens_model,omitempty"`
+	Software     string   `json:"software,omitempty"`
+	Orientation  int      `json:"orientation,omitempty"`
+	ExposureTime string   `json:"exposure_time,omitempty"`
+	FNumber      float64  `json:"f_number,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focal_length_mm,omitempty"`
+	Artist       string   `json:"artist,omitempty"`
+	Copyright    string   `json:"copyright,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Keywords     []string `json:"keywords,omitempty"`
+	GPS          *GPS     `json:"gps,omitempty"`
+}
+
+// GPS is a position in decimal degrees; Altitude is in metres above sea level.
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}